@@ -0,0 +1,95 @@
+package server
+
+import (
+	"encoding/base64"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+
+	"github.com/fragmenta/server/certcache"
+)
+
+// Config keys read by the server for autocert, these may be set
+// per environment, for example to use a staging directory in development.
+const (
+	// ConfigACMEDirectory is the URL of the ACME directory, Let's Encrypt by default
+	ConfigACMEDirectory = "autocert_directory"
+	// ConfigACMECache is the directory used to cache certs, secrets by default
+	ConfigACMECache = "autocert_cache"
+	// ConfigACMECacheSecret is used to encrypt the cert cache directory if set
+	ConfigACMECacheSecret = "autocert_cache_secret"
+	// ConfigACMEEABKeyID is the key id for external account binding
+	ConfigACMEEABKeyID = "autocert_eab_kid"
+	// ConfigACMEEABKey is the base64url encoded HMAC key for external account binding
+	ConfigACMEEABKey = "autocert_eab_key"
+)
+
+// DefaultACMECache is the directory used to cache certs if none is set.
+const DefaultACMECache = "secrets"
+
+// certManager returns an autocert manager for the email and space separated
+// domains given, using the directory, cache, host policy and external
+// account binding set in options or config.
+// Certs are requested with the tls-alpn-01 challenge, and with http-01
+// if a challenge server is started with StartTLSAuto.
+func (s *Server) certManager(email, domains string) (*autocert.Manager, error) {
+	certManager := &autocert.Manager{
+		Prompt:                 autocert.AcceptTOS,
+		Email:                  email,        // Email for problems with certs
+		HostPolicy:             s.hostPolicy, // Domains to request certs for
+		Cache:                  s.certCache,  // Cache for account keys and certs
+		Client:                 s.acmeClient, // Client for a custom ACME directory
+		ExternalAccountBinding: s.acmeEAB,
+	}
+
+	// Domains to request certs for if no policy is set
+	if certManager.HostPolicy == nil {
+		certManager.HostPolicy = autocert.HostWhitelist(strings.Fields(domains)...)
+	}
+
+	// Cache certs in the secrets folder if no cache is set,
+	// encrypting them if a secret is set in config
+	if certManager.Cache == nil {
+		dir := s.Config(ConfigACMECache)
+		if dir == "" {
+			dir = DefaultACMECache
+		}
+		certManager.Cache = autocert.DirCache(dir)
+
+		secret := s.Config(ConfigACMECacheSecret)
+		if secret != "" {
+			cache, err := certcache.NewEncryptedDir(dir, secret)
+			if err != nil {
+				return nil, err
+			}
+			certManager.Cache = cache
+		}
+	}
+
+	// Use the directory from config if no client is set
+	if certManager.Client == nil {
+		directory := s.acmeDirectory
+		if directory == "" {
+			directory = s.Config(ConfigACMEDirectory)
+		}
+		if directory != "" {
+			certManager.Client = &acme.Client{DirectoryURL: directory}
+		}
+	}
+
+	// Use external account binding from config if none is set
+	if certManager.ExternalAccountBinding == nil && s.Config(ConfigACMEEABKeyID) != "" {
+		key, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(s.Config(ConfigACMEEABKey), "="))
+		if err != nil {
+			return nil, fmt.Errorf("server: error decoding %s %v", ConfigACMEEABKey, err)
+		}
+		certManager.ExternalAccountBinding = &acme.ExternalAccountBinding{
+			KID: s.Config(ConfigACMEEABKeyID),
+			Key: key,
+		}
+	}
+
+	return certManager, nil
+}
@@ -0,0 +1,81 @@
+package server
+
+import (
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// ConfigBind is the config key for the addresses to bind to, a space or
+// comma separated list of hosts (e.g. 127.0.0.1 ::1) or host:port pairs.
+const ConfigBind = "bind"
+
+// bindAddress is a host to bind to, with an optional fixed port.
+type bindAddress struct {
+	host string
+	port int
+}
+
+// parseBind parses a list of hosts or host:port pairs,
+// separated by spaces or commas.
+func parseBind(bind string) []bindAddress {
+	var addresses []bindAddress
+	fields := strings.FieldsFunc(bind, func(r rune) bool {
+		return r == ' ' || r == ','
+	})
+	for _, f := range fields {
+		host, port, err := net.SplitHostPort(f)
+		if err == nil {
+			p, err := strconv.Atoi(port)
+			if err == nil {
+				addresses = append(addresses, bindAddress{host: host, port: p})
+				continue
+			}
+		}
+		// Otherwise treat as a bare host, which may be an ipv6 address in brackets
+		addresses = append(addresses, bindAddress{host: strings.Trim(f, "[]")})
+	}
+	return addresses
+}
+
+// bindAddresses returns the addresses set in options or config,
+// or a single address for all interfaces if none are set.
+func (s *Server) bindAddresses() []bindAddress {
+	addresses := s.bind
+	if len(addresses) == 0 {
+		addresses = parseBind(s.Config(ConfigBind))
+	}
+	if len(addresses) == 0 {
+		addresses = []bindAddress{{}}
+	}
+	return addresses
+}
+
+// Addresses returns the addresses the server listens on, made up of the
+// hosts set in options or the bind config key and the server port.
+// If no hosts are set, the server listens on all interfaces.
+func (s *Server) Addresses() []string {
+	var addresses []string
+	for _, a := range s.bindAddresses() {
+		port := a.port
+		if port == 0 {
+			port = s.port
+		}
+		addresses = append(addresses, net.JoinHostPort(a.host, strconv.Itoa(port)))
+	}
+	return addresses
+}
+
+// addressesFor returns the addresses to listen on for another port
+// (for example a redirect server), using the same hosts as the server.
+func (s *Server) addressesFor(port int) []string {
+	var addresses []string
+	for _, a := range s.bindAddresses() {
+		addr := net.JoinHostPort(a.host, strconv.Itoa(port))
+		if !slices.Contains(addresses, addr) {
+			addresses = append(addresses, addr)
+		}
+	}
+	return addresses
+}
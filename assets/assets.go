@@ -0,0 +1,235 @@
+// Package assets serves static files with fingerprinted names, so that
+// they can be cached by browsers and proxies indefinitely.
+package assets
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/fragmenta/server"
+)
+
+// DefaultPrefix is the url path assets are served under if none is given.
+const DefaultPrefix = "/assets"
+
+// CacheDays is the age in days fingerprinted assets are cached for.
+const CacheDays = 365
+
+// hashLength is the number of hex characters of the content hash used in names.
+const hashLength = 8
+
+// encodings are the precompressed siblings served if present,
+// in order of preference, by the file extension.
+var encodings = []struct {
+	name, ext string
+}{
+	{"br", ".br"},
+	{"gzip", ".gz"},
+}
+
+// Assets serves the files in an fs.FS, which may be an embed.FS.
+// Files may be requested by name, or by the fingerprinted name returned
+// by AssetPath, which is cached as immutable.
+type Assets struct {
+	fsys   fs.FS
+	prefix string
+
+	// files are indexed by name, e.g. css/app.css
+	files map[string]*file
+
+	// fingerprinted are indexed by fingerprinted name, e.g. css/app-3f2a6b1c.css
+	fingerprinted map[string]*file
+}
+
+// file describes one asset and its precompressed siblings.
+type file struct {
+	name        string
+	fingerprint string
+	hash        string
+
+	// encoded are the names of precompressed siblings by encoding
+	encoded map[string]string
+}
+
+// New returns Assets serving the files in fsys under the url prefix
+// given (DefaultPrefix if empty), hashing the content of every file.
+func New(fsys fs.FS, prefix string) (*Assets, error) {
+	if prefix == "" {
+		prefix = DefaultPrefix
+	}
+	a := &Assets{
+		fsys:          fsys,
+		prefix:        "/" + strings.Trim(prefix, "/"),
+		files:         make(map[string]*file),
+		fingerprinted: make(map[string]*file),
+	}
+
+	err := fs.WalkDir(fsys, ".", func(name string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		hash, err := hashFile(fsys, name)
+		if err != nil {
+			return err
+		}
+		a.files[name] = &file{
+			name: name,
+			hash: hash,
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("assets: error reading files %v", err)
+	}
+
+	// Precompressed siblings are served in place of their original
+	for name, f := range a.files {
+		for _, e := range encodings {
+			original, ok := a.files[strings.TrimSuffix(name, e.ext)]
+			if !ok || !strings.HasSuffix(name, e.ext) {
+				continue
+			}
+			if original.encoded == nil {
+				original.encoded = make(map[string]string)
+			}
+			original.encoded[e.name] = f.name
+		}
+	}
+
+	for _, f := range a.files {
+		f.fingerprint = fingerprint(f.name, f.hash)
+		a.fingerprinted[f.fingerprint] = f
+	}
+
+	return a, nil
+}
+
+// AssetPath returns the url path for the fingerprinted asset name,
+// e.g. app.css returns /assets/app-3f2a6b1c.css. If the asset does
+// not exist the path for the name is returned unchanged.
+func (a *Assets) AssetPath(name string) string {
+	name = strings.TrimPrefix(name, "/")
+	f, ok := a.files[name]
+	if ok {
+		name = f.fingerprint
+	}
+	return a.prefix + "/" + name
+}
+
+// ServeHTTP serves the asset requested, or a precompressed sibling if the
+// client accepts it. Fingerprinted assets are cached as immutable, other
+// assets must be revalidated using their etag.
+func (a *Assets) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	name, ok := strings.CutPrefix(r.URL.Path, a.prefix+"/")
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	days := 0
+	f, ok := a.fingerprinted[name]
+	if ok {
+		days = CacheDays
+	} else {
+		f, ok = a.files[name]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+	}
+
+	// Serve a precompressed sibling if there is one the client accepts
+	serveName, hash := f.name, f.hash
+	if len(f.encoded) > 0 {
+		server.AddVary(w.Header(), "Accept-Encoding")
+		for _, e := range encodings {
+			encodedName, ok := f.encoded[e.name]
+			if ok && server.AcceptsEncoding(r, e.name) {
+				w.Header().Set("Content-Encoding", e.name)
+				serveName, hash = encodedName, f.hash+"-"+e.name
+				break
+			}
+		}
+	}
+
+	// Fingerprinted assets never change, others must be revalidated
+	policy := server.CachePolicy{Public: true, NoCache: true, ETag: hash}
+	if days > 0 {
+		policy = server.CachePolicy{Public: true, MaxAge: time.Duration(days) * 24 * time.Hour, Immutable: true, ETag: hash}
+	}
+	if server.AddCachePolicy(w, r, policy) {
+		return
+	}
+
+	content, err := a.open(serveName)
+	if err != nil {
+		// The error page is not encoded or cacheable
+		w.Header().Del("Content-Encoding")
+		w.Header().Del("Cache-Control")
+		w.Header().Del("ETag")
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	if c, ok := content.(io.Closer); ok {
+		defer c.Close()
+	}
+
+	// The original name is used to set the content type, ServeContent
+	// also answers conditional requests using the etag
+	http.ServeContent(w, r, f.name, time.Time{}, content)
+}
+
+// open returns a seekable reader for the file, reading it into memory
+// if the file system does not provide one.
+func (a *Assets) open(name string) (io.ReadSeeker, error) {
+	f, err := a.fsys.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	rs, ok := f.(io.ReadSeeker)
+	if ok {
+		return rs, nil
+	}
+	defer f.Close()
+	b, err := io.ReadAll(f)
+	if err != nil {
+		return nil, err
+	}
+	return bytes.NewReader(b), nil
+}
+
+// hashFile returns the hex encoded hash of the file content.
+func hashFile(fsys fs.FS, name string) (string, error) {
+	f, err := fsys.Open(name)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	_, err = io.Copy(h, f)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil))[:hashLength], nil
+}
+
+// fingerprint returns the name with the hash inserted before the extension,
+// e.g. css/app.css becomes css/app-3f2a6b1c.css.
+func fingerprint(name, hash string) string {
+	ext := path.Ext(name)
+	return strings.TrimSuffix(name, ext) + "-" + hash + ext
+}
@@ -0,0 +1,98 @@
+package assets
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+// TestAssets tests assets are served by fingerprinted name with cache headers.
+func TestAssets(t *testing.T) {
+	fsys := fstest.MapFS{
+		"app.css":       {Data: []byte("body { color: red; }")},
+		"app.css.gz":    {Data: []byte("gzipped")},
+		"js/app.min.js": {Data: []byte("alert(1);")},
+	}
+	a, err := New(fsys, "")
+	if err != nil {
+		t.Fatalf("assets: error loading assets %s", err)
+	}
+
+	path := a.AssetPath("app.css")
+	if !strings.HasPrefix(path, "/assets/app-") || !strings.HasSuffix(path, ".css") || len(path) != len("/assets/app-.css")+hashLength {
+		t.Fatalf("assets: wrong asset path got:%s", path)
+	}
+	if got := a.AssetPath("js/app.min.js"); !strings.HasPrefix(got, "/assets/js/app.min-") {
+		t.Fatalf("assets: wrong nested asset path got:%s", got)
+	}
+	if got := a.AssetPath("missing.css"); got != "/assets/missing.css" {
+		t.Fatalf("assets: wrong missing asset path got:%s", got)
+	}
+
+	// Fingerprinted assets are immutable
+	r := httptest.NewRequest("GET", path, nil)
+	w := httptest.NewRecorder()
+	a.ServeHTTP(w, r)
+	if w.Code != http.StatusOK || w.Body.String() != "body { color: red; }" {
+		t.Fatalf("assets: wrong response got:%d %s", w.Code, w.Body.String())
+	}
+	if cc := w.Header().Get("Cache-Control"); cc != "public, max-age=31536000, immutable" {
+		t.Fatalf("assets: fingerprinted asset not immutable got:%s", cc)
+	}
+	if ct := w.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/css") {
+		t.Fatalf("assets: wrong content type got:%s", ct)
+	}
+	etag := w.Header().Get("ETag")
+
+	// Conditional requests get 304
+	r = httptest.NewRequest("GET", path, nil)
+	r.Header.Set("If-None-Match", etag)
+	w = httptest.NewRecorder()
+	a.ServeHTTP(w, r)
+	if w.Code != http.StatusNotModified {
+		t.Fatalf("assets: etag match wrong status got:%d", w.Code)
+	}
+
+	// Precompressed siblings are served if accepted, Vary is not repeated
+	r = httptest.NewRequest("GET", path, nil)
+	r.Header.Set("Accept-Encoding", "gzip, br;q=0")
+	w = httptest.NewRecorder()
+	w.Header().Set("Vary", "Accept-Encoding")
+	a.ServeHTTP(w, r)
+	if vary := w.Header().Values("Vary"); len(vary) != 1 {
+		t.Fatalf("assets: vary header repeated got:%v", vary)
+	}
+	if w.Header().Get("Content-Encoding") != "gzip" || w.Body.String() != "gzipped" || w.Header().Get("ETag") == etag {
+		t.Fatalf("assets: gzip sibling not served got:%s", w.Body.String())
+	}
+	if ct := w.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/css") {
+		t.Fatalf("assets: wrong gzip content type got:%s", ct)
+	}
+
+	// Unfingerprinted assets must be revalidated
+	r = httptest.NewRequest("GET", "/assets/app.css", nil)
+	w = httptest.NewRecorder()
+	a.ServeHTTP(w, r)
+	if w.Code != http.StatusOK || w.Header().Get("Cache-Control") != "public, no-cache" {
+		t.Fatalf("assets: wrong cache control got:%s", w.Header().Get("Cache-Control"))
+	}
+
+	// Errors opening files are not sent as encoded or cacheable
+	delete(fsys, "app.css.gz")
+	r = httptest.NewRequest("GET", path, nil)
+	r.Header.Set("Accept-Encoding", "gzip")
+	w = httptest.NewRecorder()
+	a.ServeHTTP(w, r)
+	if w.Code != http.StatusInternalServerError || w.Header().Get("Content-Encoding") != "" || w.Header().Get("Cache-Control") != "" {
+		t.Fatalf("assets: wrong headers for error got:%d %v", w.Code, w.Header())
+	}
+
+	r = httptest.NewRequest("GET", "/assets/missing.css", nil)
+	w = httptest.NewRecorder()
+	a.ServeHTTP(w, r)
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("assets: missing asset wrong status got:%d", w.Code)
+	}
+}
@@ -0,0 +1,99 @@
+// Package certcache provides implementations of autocert.Cache for sharing
+// account keys and certs between servers, or storing them encrypted at rest.
+package certcache
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// keyInfo is used to derive the encryption key from the secret
+const keyInfo = "fragmenta certcache v1"
+
+// pemPrefix starts the unencrypted data stored by autocert
+var pemPrefix = []byte("-----BEGIN ")
+
+// Encrypted wraps another autocert.Cache, encrypting data with AES-GCM
+// before it is stored and decrypting it when read.
+type Encrypted struct {
+	cache autocert.Cache
+	aead  cipher.AEAD
+}
+
+// NewEncrypted returns a cache which encrypts data stored in cache,
+// using a key derived from secret, which should be long and random.
+func NewEncrypted(cache autocert.Cache, secret string) (*Encrypted, error) {
+	if len(secret) < 16 {
+		return nil, errors.New("certcache: secret must be at least 16 characters")
+	}
+
+	key, err := hkdf.Key(sha256.New, []byte(secret), nil, keyInfo, 32)
+	if err != nil {
+		return nil, fmt.Errorf("certcache: error deriving key %v", err)
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("certcache: error creating cipher %v", err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, fmt.Errorf("certcache: error creating cipher %v", err)
+	}
+
+	return &Encrypted{cache: cache, aead: aead}, nil
+}
+
+// NewEncryptedDir returns a cache which stores data encrypted in files in dir.
+func NewEncryptedDir(dir string, secret string) (*Encrypted, error) {
+	return NewEncrypted(autocert.DirCache(dir), secret)
+}
+
+// Get returns the decrypted data for key, or autocert.ErrCacheMiss if not found.
+// Unencrypted pem data, stored before encryption was enabled, is treated as
+// a miss so that autocert replaces it. Data which cannot be decrypted returns
+// an error, as the secret is wrong, and certs should not be issued again.
+func (e *Encrypted) Get(ctx context.Context, key string) ([]byte, error) {
+	data, err := e.cache.Get(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	if bytes.HasPrefix(data, pemPrefix) {
+		return nil, autocert.ErrCacheMiss
+	}
+
+	size := e.aead.NonceSize()
+	if len(data) < size {
+		return nil, fmt.Errorf("certcache: decrypt %s: data too short", key)
+	}
+
+	// The key is used as additional data, so entries cannot be swapped
+	plain, err := e.aead.Open(nil, data[:size], data[size:], []byte(key))
+	if err != nil {
+		return nil, fmt.Errorf("certcache: decrypt %s: %w", key, err)
+	}
+	return plain, nil
+}
+
+// Put encrypts data and stores it under key.
+func (e *Encrypted) Put(ctx context.Context, key string, data []byte) error {
+	nonce := make([]byte, e.aead.NonceSize())
+	_, err := rand.Read(nonce)
+	if err != nil {
+		return fmt.Errorf("certcache: error generating nonce %v", err)
+	}
+	return e.cache.Put(ctx, key, e.aead.Seal(nonce, nonce, data, []byte(key)))
+}
+
+// Delete removes the data stored under key.
+func (e *Encrypted) Delete(ctx context.Context, key string) error {
+	return e.cache.Delete(ctx, key)
+}
@@ -0,0 +1,114 @@
+package certcache
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"regexp"
+	"time"
+
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// Placeholder returns the bind parameter for argument n (counting from 1)
+// in the sql dialect of a database.
+type Placeholder func(n int) string
+
+// DollarPlaceholder returns placeholders of the form $1, used by postgres.
+func DollarPlaceholder(n int) string {
+	return fmt.Sprintf("$%d", n)
+}
+
+// QuestionPlaceholder returns placeholders of the form ?, used by mysql and sqlite.
+func QuestionPlaceholder(n int) string {
+	return "?"
+}
+
+// validTable matches table names which are safe to use in queries.
+var validTable = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_.]*$`)
+
+// SQL stores account keys and certs in a database table, so that
+// they can be shared by several servers. The table should be created with
+// columns for the name, data and time updated, for example in postgres:
+//
+//	CREATE TABLE autocert_cache (
+//		name varchar(255) PRIMARY KEY,
+//		data bytea NOT NULL,
+//		updated_at timestamp NOT NULL
+//	);
+//
+// Data is stored unencrypted, wrap the cache with NewEncrypted to encrypt it.
+type SQL struct {
+	db          *sql.DB
+	table       string
+	placeholder Placeholder
+}
+
+// NewSQL returns a cache which stores data in table using db, with the
+// placeholders given for the database driver (e.g. DollarPlaceholder).
+func NewSQL(db *sql.DB, table string, placeholder Placeholder) (*SQL, error) {
+	if db == nil {
+		return nil, errors.New("certcache: nil database")
+	}
+	if !validTable.MatchString(table) {
+		return nil, fmt.Errorf("certcache: invalid table name %s", table)
+	}
+	if placeholder == nil {
+		placeholder = DollarPlaceholder
+	}
+	return &SQL{db: db, table: table, placeholder: placeholder}, nil
+}
+
+// Get returns the data stored for key, or autocert.ErrCacheMiss if not found.
+func (s *SQL) Get(ctx context.Context, key string) ([]byte, error) {
+	q := s.query("SELECT data FROM %s WHERE name=%s", 1)
+	var data []byte
+	err := s.db.QueryRowContext(ctx, q, key).Scan(&data)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, autocert.ErrCacheMiss
+	}
+	if err != nil {
+		return nil, fmt.Errorf("certcache: error reading %s %v", key, err)
+	}
+	return data, nil
+}
+
+// Put stores data under key, replacing any existing data.
+func (s *SQL) Put(ctx context.Context, key string, data []byte) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("certcache: error storing %s %v", key, err)
+	}
+	defer tx.Rollback()
+
+	// Delete then insert, as upsert syntax is not portable between databases
+	_, err = tx.ExecContext(ctx, s.query("DELETE FROM %s WHERE name=%s", 1), key)
+	if err != nil {
+		return fmt.Errorf("certcache: error storing %s %v", key, err)
+	}
+	_, err = tx.ExecContext(ctx, s.query("INSERT INTO %s (name, data, updated_at) VALUES (%s, %s, %s)", 3), key, data, time.Now().UTC())
+	if err != nil {
+		return fmt.Errorf("certcache: error storing %s %v", key, err)
+	}
+
+	return tx.Commit()
+}
+
+// Delete removes the data stored under key.
+func (s *SQL) Delete(ctx context.Context, key string) error {
+	_, err := s.db.ExecContext(ctx, s.query("DELETE FROM %s WHERE name=%s", 1), key)
+	if err != nil {
+		return fmt.Errorf("certcache: error deleting %s %v", key, err)
+	}
+	return nil
+}
+
+// query formats a query for our table with n placeholders.
+func (s *SQL) query(format string, n int) string {
+	args := []any{s.table}
+	for i := 1; i <= n; i++ {
+		args = append(args, s.placeholder(i))
+	}
+	return fmt.Sprintf(format, args...)
+}
@@ -0,0 +1,185 @@
+package server
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/fragmenta/server/log"
+)
+
+// ConfigCertReloadInterval is the config key for the interval at which
+// cert and key files are checked for changes, 0 or none disables reloading.
+const ConfigCertReloadInterval = "server_cert_reload_interval"
+
+// DefaultCertReloadInterval is the default interval at which cert and key
+// files are checked for changes.
+const DefaultCertReloadInterval = time.Minute
+
+// CertReloader loads a tls certificate and key pair from files and reloads
+// them when the files change, so that certs can be rotated without a restart.
+// A new pair is validated before use, if it is invalid the old pair is kept.
+type CertReloader struct {
+	certFile string
+	keyFile  string
+
+	// cert is the current certificate, swapped atomically on reload
+	cert atomic.Pointer[tls.Certificate]
+
+	// mu protects the fields below
+	mu       sync.Mutex
+	modified time.Time
+	stop     chan struct{}
+}
+
+// NewCertReloader returns a CertReloader for the cert and key files given,
+// it returns an error if the files cannot be loaded or are invalid.
+func NewCertReloader(certFile, keyFile string) (*CertReloader, error) {
+	c := &CertReloader{
+		certFile: certFile,
+		keyFile:  keyFile,
+	}
+	c.modified = c.modTime()
+	err := c.Reload()
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// GetCertificate returns the current certificate,
+// it is suitable for use as tls.Config.GetCertificate.
+func (c *CertReloader) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return c.cert.Load(), nil
+}
+
+// Reload loads and validates the cert and key files, and if they are valid
+// swaps them in for new connections. If not, the old pair is kept in use.
+// An expired cert is only used if no cert has been loaded yet.
+func (c *CertReloader) Reload() error {
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return fmt.Errorf("server: error loading cert %s %v", c.certFile, err)
+	}
+
+	// The leaf is parsed by LoadX509KeyPair, but check for older behaviour
+	if cert.Leaf == nil {
+		cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0])
+		if err != nil {
+			return fmt.Errorf("server: error parsing cert %s %v", c.certFile, err)
+		}
+	}
+
+	// A cert which has expired or is not yet valid does not replace the
+	// current cert, but is used at startup as there is nothing else to serve
+	now := time.Now()
+	if now.After(cert.Leaf.NotAfter) || now.Before(cert.Leaf.NotBefore) {
+		err = fmt.Errorf("server: cert %s is not valid at %s (valid %s to %s)", c.certFile, now.UTC(), cert.Leaf.NotBefore.UTC(), cert.Leaf.NotAfter.UTC())
+		if c.cert.Load() != nil {
+			return err
+		}
+		log.Error(log.V{log.MessageKey: "server: warning, serving cert outside its validity period", log.ErrorKey: err})
+	}
+
+	c.cert.Store(&cert)
+
+	log.Info(log.V{
+		log.MessageKey: "server: loaded cert",
+		"cert":         c.certFile,
+		"subject":      cert.Leaf.Subject.String(),
+		"expires":      cert.Leaf.NotAfter.UTC(),
+		"fingerprint":  fmt.Sprintf("%X", sha256.Sum256(cert.Leaf.Raw)),
+	})
+
+	return nil
+}
+
+// Watch checks the cert and key files for changes at the interval given,
+// reloading them when they change. Errors are logged and the old pair kept.
+// Call Stop to stop watching.
+func (c *CertReloader) Watch(interval time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.stop != nil || interval <= 0 {
+		return
+	}
+	c.stop = make(chan struct{})
+
+	go func(stop chan struct{}) {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				c.check()
+			case <-stop:
+				return
+			}
+		}
+	}(c.stop)
+}
+
+// Stop stops watching the cert and key files for changes.
+func (c *CertReloader) Stop() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.stop != nil {
+		close(c.stop)
+		c.stop = nil
+	}
+}
+
+// check reloads the files if they have been modified since the last check.
+func (c *CertReloader) check() {
+	modified := c.modTime()
+
+	c.mu.Lock()
+	changed := !modified.Equal(c.modified)
+	c.modified = modified
+	c.mu.Unlock()
+
+	if !changed {
+		return
+	}
+
+	// If the files are only partially rotated this will fail,
+	// but they will be reloaded again on the next change.
+	err := c.Reload()
+	if err != nil {
+		log.Error(log.V{log.MessageKey: "server: error reloading cert, keeping old cert", log.ErrorKey: err})
+	}
+}
+
+// modTime returns the latest modification time of the cert and key files.
+func (c *CertReloader) modTime() time.Time {
+	var latest time.Time
+	for _, path := range []string{c.certFile, c.keyFile} {
+		info, err := os.Stat(path)
+		if err != nil {
+			continue
+		}
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest
+}
+
+// watchCerts watches the cert and key files of reloader for changes
+// until the server shuts down, it should be called once serving.
+func (s *Server) watchCerts(reloader *CertReloader) {
+	interval := s.timeout(s.certReloadInterval, ConfigCertReloadInterval, DefaultCertReloadInterval)
+	if interval > 0 {
+		reloader.Watch(interval)
+		s.OnShutdown(func(ctx context.Context) error {
+			reloader.Stop()
+			return nil
+		})
+	}
+}
@@ -0,0 +1,164 @@
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeTestCert writes a self-signed cert and key for name to dir.
+func writeTestCert(t *testing.T, dir, name string) (string, string) {
+	return writeTestCertValid(t, dir, name, time.Now().Add(-time.Hour), time.Now().Add(time.Hour))
+}
+
+// writeTestCertValid writes a self-signed cert and key for name to dir,
+// which is valid between the times given.
+func writeTestCertValid(t *testing.T, dir, name string, notBefore, notAfter time.Time) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("server: error generating key %s", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		NotBefore:    notBefore,
+		NotAfter:     notAfter,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("server: error creating cert %s", err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("server: error marshalling key %s", err)
+	}
+
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+	err = os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	if err != nil {
+		t.Fatalf("server: error writing cert %s", err)
+	}
+	err = os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600)
+	if err != nil {
+		t.Fatalf("server: error writing key %s", err)
+	}
+	return certFile, keyFile
+}
+
+// TestCertReloader tests certs are swapped on reload, and invalid certs are rejected.
+func TestCertReloader(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := writeTestCert(t, dir, "first.example.com")
+
+	c, err := NewCertReloader(certFile, keyFile)
+	if err != nil {
+		t.Fatalf("server: error loading cert %s", err)
+	}
+
+	cert, _ := c.GetCertificate(&tls.ClientHelloInfo{})
+	if cert.Leaf.Subject.CommonName != "first.example.com" {
+		t.Fatalf("server: wrong cert loaded got:%s", cert.Leaf.Subject.CommonName)
+	}
+
+	// Rotate the files and reload
+	writeTestCert(t, dir, "second.example.com")
+	err = c.Reload()
+	if err != nil {
+		t.Fatalf("server: error reloading cert %s", err)
+	}
+	cert, _ = c.GetCertificate(&tls.ClientHelloInfo{})
+	if cert.Leaf.Subject.CommonName != "second.example.com" {
+		t.Fatalf("server: cert not reloaded got:%s", cert.Leaf.Subject.CommonName)
+	}
+
+	// Break the key and check the old cert is kept
+	err = os.WriteFile(keyFile, []byte("invalid"), 0600)
+	if err != nil {
+		t.Fatalf("server: error writing key %s", err)
+	}
+	err = c.Reload()
+	if err == nil {
+		t.Fatalf("server: no error reloading invalid key")
+	}
+	cert, _ = c.GetCertificate(&tls.ClientHelloInfo{})
+	if cert.Leaf.Subject.CommonName != "second.example.com" {
+		t.Fatalf("server: cert not kept after invalid reload got:%s", cert.Leaf.Subject.CommonName)
+	}
+
+	// An expired cert does not replace a valid one on reload
+	expired := time.Now().Add(-time.Hour)
+	writeTestCertValid(t, dir, "expired.example.com", expired.Add(-time.Hour), expired)
+	err = c.Reload()
+	if err == nil {
+		t.Fatalf("server: no error reloading expired cert")
+	}
+	cert, _ = c.GetCertificate(&tls.ClientHelloInfo{})
+	if cert.Leaf.Subject.CommonName != "second.example.com" {
+		t.Fatalf("server: cert not kept after expired reload got:%s", cert.Leaf.Subject.CommonName)
+	}
+
+	// But an expired cert is served at startup as there is no other
+	c, err = NewCertReloader(certFile, keyFile)
+	if err != nil {
+		t.Fatalf("server: error loading expired cert %s", err)
+	}
+	cert, _ = c.GetCertificate(&tls.ClientHelloInfo{})
+	if cert.Leaf.Subject.CommonName != "expired.example.com" {
+		t.Fatalf("server: expired cert not loaded got:%s", cert.Leaf.Subject.CommonName)
+	}
+}
+
+// TestClientIdentity tests client identities are read from the request tls state.
+func TestClientIdentity(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := writeTestCert(t, dir, "client.example.com")
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		t.Fatalf("server: error loading cert %s", err)
+	}
+
+	r := httptest.NewRequest("GET", "/", nil)
+	if GetClientIdentity(r) != nil {
+		t.Fatalf("server: identity found for request without tls")
+	}
+
+	r.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert.Leaf}}
+	var got *ClientIdentity
+	h := ClientIdentityMiddleware(func(w http.ResponseWriter, r *http.Request) {
+		// Check the identity is read from the context, not the tls state
+		r.TLS = nil
+		got = GetClientIdentity(r)
+	})
+	h(httptest.NewRecorder(), r)
+
+	if got == nil || got.CommonName != "client.example.com" || got.Verified {
+		t.Fatalf("server: wrong identity got:%v", got)
+	}
+	if len(got.SANs) != 1 || got.SANs[0] != "client.example.com" {
+		t.Fatalf("server: wrong sans got:%v", got.SANs)
+	}
+
+	// Check client auth is applied from a CA bundle
+	s := &Server{clientCA: certFile}
+	tlsConfig := &tls.Config{}
+	err = s.applyClientAuth(tlsConfig)
+	if err != nil {
+		t.Fatalf("server: error applying client auth %s", err)
+	}
+	if tlsConfig.ClientAuth != tls.RequireAndVerifyClientCert || tlsConfig.ClientCAs == nil {
+		t.Fatalf("server: client auth not applied got:%v", tlsConfig.ClientAuth)
+	}
+}
@@ -0,0 +1,171 @@
+package server
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"os"
+
+	"github.com/fragmenta/server/log"
+)
+
+// Config keys read by the server for mutual tls (client certificates).
+const (
+	// ConfigClientCA is the path of a pem bundle of CAs to verify client certs
+	ConfigClientCA = "server_client_ca"
+	// ConfigClientAuth is the client auth mode - request, require, verify or verify_if_given
+	ConfigClientAuth = "server_client_auth"
+)
+
+// clientAuthTypes maps the config names of client auth modes to tls types.
+var clientAuthTypes = map[string]tls.ClientAuthType{
+	"none":            tls.NoClientCert,
+	"request":         tls.RequestClientCert,
+	"require":         tls.RequireAnyClientCert,
+	"verify":          tls.RequireAndVerifyClientCert,
+	"verify_if_given": tls.VerifyClientCertIfGiven,
+}
+
+// applyClientAuth sets the client auth mode and CA pool on tlsConfig
+// from options or config, if client auth is not set it does nothing.
+func (s *Server) applyClientAuth(tlsConfig *tls.Config) error {
+	caFile := s.clientCA
+	if caFile == "" {
+		caFile = s.Config(ConfigClientCA)
+	}
+	auth := s.clientAuth
+	if auth == tls.NoClientCert {
+		mode := s.Config(ConfigClientAuth)
+		if mode != "" {
+			var ok bool
+			auth, ok = clientAuthTypes[mode]
+			if !ok {
+				return fmt.Errorf("server: invalid client auth mode %s", mode)
+			}
+		} else if caFile != "" {
+			// If only a CA is given, verify client certs
+			auth = tls.RequireAndVerifyClientCert
+		}
+	}
+
+	if auth == tls.NoClientCert {
+		return nil
+	}
+	tlsConfig.ClientAuth = auth
+
+	if caFile == "" {
+		if auth == tls.RequireAndVerifyClientCert || auth == tls.VerifyClientCertIfGiven {
+			return fmt.Errorf("server: client cert verification requires a CA bundle")
+		}
+		return nil
+	}
+
+	pem, err := os.ReadFile(caFile)
+	if err != nil {
+		return fmt.Errorf("server: error reading client CA %s %v", caFile, err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return fmt.Errorf("server: no certs found in client CA %s", caFile)
+	}
+	tlsConfig.ClientCAs = pool
+
+	return nil
+}
+
+// ClientIdentity is the identity of a peer which presented a client cert.
+type ClientIdentity struct {
+	// Subject is the distinguished name of the cert subject
+	Subject string
+
+	// CommonName is the common name of the cert subject
+	CommonName string
+
+	// SANs are the subject alternative names (DNS names, emails, URIs and IPs)
+	SANs []string
+
+	// Fingerprint is the hex encoded SHA-256 hash of the cert
+	Fingerprint string
+
+	// Verified is true if the cert was verified against the client CAs
+	Verified bool
+}
+
+// String returns a string representation of this identity, useful for logging.
+func (c *ClientIdentity) String() string {
+	return fmt.Sprintf("%s (%s)", c.Subject, c.Fingerprint)
+}
+
+// NewClientIdentity returns the identity for a client cert.
+func NewClientIdentity(cert *x509.Certificate, verified bool) *ClientIdentity {
+	c := &ClientIdentity{
+		Subject:     cert.Subject.String(),
+		CommonName:  cert.Subject.CommonName,
+		Fingerprint: fmt.Sprintf("%X", sha256.Sum256(cert.Raw)),
+		Verified:    verified,
+	}
+	c.SANs = append(c.SANs, cert.DNSNames...)
+	c.SANs = append(c.SANs, cert.EmailAddresses...)
+	for _, uri := range cert.URIs {
+		c.SANs = append(c.SANs, uri.String())
+	}
+	for _, ip := range cert.IPAddresses {
+		c.SANs = append(c.SANs, ip.String())
+	}
+	return c
+}
+
+type clientIdentityKey struct{}
+
+// GetClientIdentity returns the identity of the client cert presented with
+// the request, or nil if there was none.
+func GetClientIdentity(r *http.Request) *ClientIdentity {
+	c, ok := r.Context().Value(clientIdentityKey{}).(*ClientIdentity)
+	if ok {
+		return c
+	}
+	return requestClientIdentity(r)
+}
+
+// SetClientIdentity saves the client identity in the request context.
+func SetClientIdentity(r *http.Request, c *ClientIdentity) *http.Request {
+	ctx := context.WithValue(r.Context(), clientIdentityKey{}, c)
+	return r.WithContext(ctx)
+}
+
+// requestClientIdentity reads the client identity from the request tls state.
+func requestClientIdentity(r *http.Request) *ClientIdentity {
+	if r.TLS == nil || len(r.TLS.PeerCertificates) == 0 {
+		return nil
+	}
+	verified := len(r.TLS.VerifiedChains) > 0
+	return NewClientIdentity(r.TLS.PeerCertificates[0], verified)
+}
+
+// ClientIdentityMiddleware adds the client cert identity to the request
+// context and logs it with the request trace id. It should be wrapped by
+// log.Middleware so that the trace id is set.
+func ClientIdentityMiddleware(h http.HandlerFunc) http.HandlerFunc {
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		c := requestClientIdentity(r)
+		if c != nil {
+			r = SetClientIdentity(r, c)
+
+			log.Info(log.V{
+				log.MessageKey: "<- Client",
+				"subject":      c.Subject,
+				"sans":         c.SANs,
+				"fingerprint":  c.Fingerprint,
+				"verified":     c.Verified,
+				log.TraceKey:   log.Trace(r),
+			})
+		}
+
+		h(w, r)
+	}
+
+}
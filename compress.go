@@ -0,0 +1,361 @@
+package server
+
+import (
+	"bufio"
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// DefaultCompressMinSize is the size below which responses are not compressed.
+const DefaultCompressMinSize = 1024
+
+// DefaultCompressTypes are the content types compressed by default,
+// types which are already compressed like images and archives are not included.
+var DefaultCompressTypes = []string{
+	"text/html",
+	"text/css",
+	"text/plain",
+	"text/xml",
+	"text/csv",
+	"text/javascript",
+	"application/javascript",
+	"application/json",
+	"application/problem+json",
+	"application/xml",
+	"application/rss+xml",
+	"application/atom+xml",
+	"application/manifest+json",
+	"application/wasm",
+	"image/svg+xml",
+}
+
+// DefaultCompressEncodings are the encodings supported, in order of preference.
+var DefaultCompressEncodings = []string{"zstd", "gzip", "deflate"}
+
+// Compressor is a middleware which compresses responses with the encoding
+// the client prefers from those in Accept-Encoding.
+// Responses which are smaller than MinSize, have a type not in Types, or
+// already have a Content-Encoding are not compressed.
+// ETags on compressed responses are weakened, as the bytes sent differ.
+type Compressor struct {
+	// MinSize is the size below which responses are not compressed
+	MinSize int
+
+	// Types are the content types to compress, without parameters
+	Types []string
+
+	// Encodings are the encodings to use in order of preference,
+	// from zstd, gzip and deflate
+	Encodings []string
+}
+
+// NewCompressor returns a Compressor using the default types and encodings.
+func NewCompressor() *Compressor {
+	return &Compressor{
+		MinSize:   DefaultCompressMinSize,
+		Types:     DefaultCompressTypes,
+		Encodings: DefaultCompressEncodings,
+	}
+}
+
+// Middleware compresses responses if the client accepts compression.
+func (c *Compressor) Middleware(h http.HandlerFunc) http.HandlerFunc {
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		// Responses differ by Accept-Encoding whether or not we compress this one
+		AddVary(w.Header(), "Accept-Encoding")
+
+		encoding := c.negotiate(r.Header.Get("Accept-Encoding"))
+		if encoding == "" || r.Method == http.MethodHead || r.Header.Get("Range") != "" {
+			h(w, r)
+			return
+		}
+
+		cw := &compressWriter{
+			ResponseWriter: w,
+			compressor:     c,
+			encoding:       encoding,
+			status:         http.StatusOK,
+		}
+		defer cw.close()
+		h(cw, r)
+		cw.finish()
+	}
+
+}
+
+// negotiate returns the encoding with the highest quality in the
+// Accept-Encoding header, or an empty string if none are acceptable.
+func (c *Compressor) negotiate(accept string) string {
+	if accept == "" {
+		return ""
+	}
+	encodings := c.Encodings
+	if encodings == nil {
+		encodings = DefaultCompressEncodings
+	}
+	best, bestQ := "", 0.0
+	for _, encoding := range encodings {
+		if encoderPools[encoding] == nil {
+			continue
+		}
+		q := acceptQuality(accept, encoding)
+		if q > bestQ {
+			best, bestQ = encoding, q
+		}
+	}
+	return best
+}
+
+// compressible returns true if the content type is in the allowed types.
+func (c *Compressor) compressible(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	types := c.Types
+	if types == nil {
+		types = DefaultCompressTypes
+	}
+	for _, t := range types {
+		if strings.EqualFold(t, mediaType) {
+			return true
+		}
+	}
+	return false
+}
+
+// AcceptsEncoding returns true if the request accepts the content encoding given.
+func AcceptsEncoding(r *http.Request, encoding string) bool {
+	return acceptQuality(r.Header.Get("Accept-Encoding"), encoding) > 0
+}
+
+// acceptQuality returns the quality given for encoding in the Accept-Encoding
+// header, falling back to the quality for *, or 0 if it is not acceptable.
+func acceptQuality(accept, encoding string) float64 {
+	wildcard := 0.0
+	for _, part := range strings.Split(accept, ",") {
+		name, params, _ := strings.Cut(part, ";")
+		name = strings.ToLower(strings.TrimSpace(name))
+
+		q := 1.0
+		value, ok := strings.CutPrefix(strings.TrimSpace(params), "q=")
+		if ok {
+			var err error
+			q, err = strconv.ParseFloat(value, 64)
+			if err != nil {
+				q = 0
+			}
+		}
+
+		switch name {
+		case encoding:
+			return q
+		case "*":
+			wildcard = q
+		}
+	}
+	return wildcard
+}
+
+// AddVary adds value to the Vary header unless it is already present,
+// or the header is * which varies on everything.
+func AddVary(header http.Header, value string) {
+	for _, v := range header.Values("Vary") {
+		for _, field := range strings.Split(v, ",") {
+			field = strings.TrimSpace(field)
+			if field == "*" || strings.EqualFold(field, value) {
+				return
+			}
+		}
+	}
+	header.Add("Vary", value)
+}
+
+// encoder is the interface shared by the compressing writers.
+type encoder interface {
+	io.WriteCloser
+	Flush() error
+	Reset(w io.Writer)
+}
+
+// encoderPools hold compressing writers for reuse, by encoding name.
+var encoderPools = map[string]*sync.Pool{
+	"gzip": {New: func() any {
+		return gzip.NewWriter(nil)
+	}},
+	"deflate": {New: func() any {
+		// Deflate in http is the zlib format
+		return zlib.NewWriter(nil)
+	}},
+	"zstd": {New: func() any {
+		w, _ := zstd.NewWriter(nil, zstd.WithEncoderConcurrency(1))
+		return w
+	}},
+}
+
+// compressWriter buffers the start of a response until it knows whether
+// the response should be compressed, then streams it through an encoder.
+type compressWriter struct {
+	http.ResponseWriter
+	compressor *Compressor
+	encoding   string
+	encoder    encoder
+	buf        []byte
+	status     int
+
+	// wroteHeader is set when the handler calls WriteHeader
+	wroteHeader bool
+
+	// started is set once the header has been sent
+	started bool
+
+	// hijacked is set once the handler has taken over the connection
+	hijacked bool
+}
+
+// WriteHeader records the status, the header is sent once we know
+// whether the response is compressed.
+func (cw *compressWriter) WriteHeader(status int) {
+	// Informational responses are sent immediately
+	if status >= 100 && status < 200 && status != http.StatusSwitchingProtocols {
+		cw.ResponseWriter.WriteHeader(status)
+		return
+	}
+	if cw.started || cw.wroteHeader {
+		cw.ResponseWriter.WriteHeader(status)
+		return
+	}
+	cw.wroteHeader = true
+	cw.status = status
+	switch status {
+	case http.StatusNoContent, http.StatusPartialContent, http.StatusNotModified, http.StatusSwitchingProtocols:
+		cw.start(false)
+	}
+}
+
+// Write buffers the body until MinSize is reached, then compresses it.
+func (cw *compressWriter) Write(b []byte) (int, error) {
+	if !cw.wroteHeader {
+		cw.WriteHeader(http.StatusOK)
+	}
+	if !cw.started {
+		cw.buf = append(cw.buf, b...)
+		if len(cw.buf) < cw.minSize() {
+			return len(b), nil
+		}
+		return len(b), cw.start(true)
+	}
+	if cw.encoder != nil {
+		return cw.encoder.Write(b)
+	}
+	return cw.ResponseWriter.Write(b)
+}
+
+// Flush sends the response so far, compressing it if the type allows
+// regardless of size, as the handler wants it sent immediately.
+func (cw *compressWriter) Flush() {
+	if !cw.wroteHeader {
+		cw.WriteHeader(http.StatusOK)
+	}
+	if !cw.started {
+		cw.start(true)
+	}
+	if cw.encoder != nil {
+		cw.encoder.Flush()
+	}
+	http.NewResponseController(cw.ResponseWriter).Flush()
+}
+
+// Hijack hijacks the underlying connection, for example for websockets,
+// nothing more is written to the response once it is hijacked.
+func (cw *compressWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn, rw, err := http.NewResponseController(cw.ResponseWriter).Hijack()
+	if err == nil {
+		cw.hijacked = true
+	}
+	return conn, rw, err
+}
+
+// Unwrap returns the underlying writer for http.ResponseController.
+func (cw *compressWriter) Unwrap() http.ResponseWriter {
+	return cw.ResponseWriter
+}
+
+// start sends the header, deciding whether to compress the response
+// if compress is true, and writes any buffered body.
+func (cw *compressWriter) start(compress bool) error {
+	cw.started = true
+	header := cw.Header()
+
+	// Set the type before compressing, as it can't be sniffed afterwards
+	if header.Get("Content-Type") == "" && len(cw.buf) > 0 {
+		header.Set("Content-Type", http.DetectContentType(cw.buf))
+	}
+
+	if compress && header.Get("Content-Encoding") == "" &&
+		cw.compressor.compressible(header.Get("Content-Type")) {
+		header.Set("Content-Encoding", cw.encoding)
+		header.Del("Content-Length")
+		etag := header.Get("ETag")
+		if etag != "" {
+			header.Set("ETag", WeakETag(etag))
+		}
+		cw.encoder = encoderPools[cw.encoding].Get().(encoder)
+		cw.encoder.Reset(cw.ResponseWriter)
+	}
+
+	cw.ResponseWriter.WriteHeader(cw.status)
+	if len(cw.buf) == 0 {
+		return nil
+	}
+	var err error
+	if cw.encoder != nil {
+		_, err = cw.encoder.Write(cw.buf)
+	} else {
+		_, err = cw.ResponseWriter.Write(cw.buf)
+	}
+	cw.buf = nil
+	return err
+}
+
+// finish sends a response smaller than MinSize uncompressed,
+// and completes a compressed response.
+func (cw *compressWriter) finish() {
+	if cw.hijacked {
+		return
+	}
+	if !cw.started && (cw.wroteHeader || len(cw.buf) > 0) {
+		cw.start(false)
+	}
+	if cw.encoder != nil {
+		cw.encoder.Close()
+	}
+}
+
+// close returns the encoder to the pool, it is deferred so that
+// it runs even if the handler panics.
+func (cw *compressWriter) close() {
+	if cw.encoder != nil {
+		cw.encoder.Reset(nil)
+		encoderPools[cw.encoding].Put(cw.encoder)
+		cw.encoder = nil
+	}
+}
+
+// minSize returns the size below which responses are not compressed.
+func (cw *compressWriter) minSize() int {
+	if cw.compressor.MinSize > 0 {
+		return cw.compressor.MinSize
+	}
+	return DefaultCompressMinSize
+}
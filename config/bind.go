@@ -0,0 +1,206 @@
+package config
+
+import (
+	"encoding"
+	"errors"
+	"fmt"
+	"net/url"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Bind sets the fields of the struct pointed to by v from config values,
+// using the key in the config tag of each field, and the default tag if
+// there is no value. Keys marked required must have a value. For example:
+//
+//	type AppConfig struct {
+//		DBUser  string        `config:"db_user,required"`
+//		Port    int           `config:"port" default:"3000"`
+//		Timeout time.Duration `config:"timeout" default:"5s"`
+//		Hosts   []string      `config:"hosts"`
+//		Mail    MailConfig    `config:"mail"` // reads mail_from etc.
+//	}
+//
+// Supported types are strings, bools, ints, uints, floats, durations, urls,
+// slices of these (comma separated), encoding.TextUnmarshaler, and nested
+// structs, whose keys are prefixed by the key of the struct and _ if given.
+// Every missing or invalid key is listed in the error returned.
+func (c *Config) Bind(v any) error {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Pointer || rv.IsNil() || rv.Elem().Kind() != reflect.Struct {
+		return fmt.Errorf("config: Bind requires a pointer to a struct, got %T", v)
+	}
+	var errs []error
+	c.bindStruct(rv.Elem(), "", &errs)
+	return errors.Join(errs...)
+}
+
+// Bind sets the fields of the struct pointed to by v from the current config
+func Bind(v any) error {
+	return Current.Bind(v)
+}
+
+var (
+	durationType = reflect.TypeFor[time.Duration]()
+	urlType      = reflect.TypeFor[url.URL]()
+	textType     = reflect.TypeFor[encoding.TextUnmarshaler]()
+)
+
+// bindStruct sets the fields of the struct value, prefixing keys with prefix.
+func (c *Config) bindStruct(rv reflect.Value, prefix string, errs *[]error) {
+	rt := rv.Type()
+	for i := 0; i < rt.NumField(); i++ {
+		field := rt.Field(i)
+		if !field.IsExported() {
+			continue
+		}
+		tag, hasTag := field.Tag.Lookup("config")
+		key, options, _ := strings.Cut(tag, ",")
+		if key == "-" {
+			continue
+		}
+		if prefix != "" && key != "" {
+			key = prefix + "_" + key
+		} else if key == "" {
+			key = prefix
+		}
+
+		fv := rv.Field(i)
+
+		// Nested structs set their own fields, other fields need a key
+		if isNested(field.Type) {
+			if field.Type.Kind() == reflect.Pointer {
+				if fv.IsNil() {
+					fv.Set(reflect.New(field.Type.Elem()))
+				}
+				fv = fv.Elem()
+			}
+			c.bindStruct(fv, key, errs)
+			continue
+		}
+		if !hasTag || key == "" {
+			continue
+		}
+
+		value := c.Get(key)
+		if value == "" {
+			value = field.Tag.Get("default")
+		}
+		if value == "" {
+			if options == "required" {
+				*errs = append(*errs, fmt.Errorf("config: missing required key %s", key))
+			}
+			continue
+		}
+
+		err := setValue(fv, value)
+		if err != nil {
+			*errs = append(*errs, fmt.Errorf("config: invalid value for %s %q: %v", key, value, err))
+		}
+	}
+}
+
+// isNested returns true if t is a struct (or pointer to a struct)
+// which should be bound field by field.
+func isNested(t reflect.Type) bool {
+	if t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	return t.Kind() == reflect.Struct && t != urlType &&
+		!reflect.PointerTo(t).Implements(textType)
+}
+
+// setValue parses value and sets it on fv.
+func setValue(fv reflect.Value, value string) error {
+	if fv.Kind() == reflect.Pointer {
+		if fv.IsNil() {
+			fv.Set(reflect.New(fv.Type().Elem()))
+		}
+		return setValue(fv.Elem(), value)
+	}
+
+	if fv.CanAddr() && fv.Addr().Type().Implements(textType) {
+		return fv.Addr().Interface().(encoding.TextUnmarshaler).UnmarshalText([]byte(value))
+	}
+
+	switch fv.Type() {
+	case durationType:
+		d, err := parseDuration(value)
+		if err != nil {
+			return err
+		}
+		fv.SetInt(int64(d))
+		return nil
+	case urlType:
+		u, err := url.Parse(value)
+		if err != nil {
+			return err
+		}
+		fv.Set(reflect.ValueOf(*u))
+		return nil
+	}
+
+	switch fv.Kind() {
+	case reflect.String:
+		fv.SetString(value)
+	case reflect.Bool:
+		b, err := parseBool(value)
+		if err != nil {
+			return err
+		}
+		fv.SetBool(b)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		i, err := strconv.ParseInt(value, 10, fv.Type().Bits())
+		if err != nil {
+			return errors.Unwrap(err)
+		}
+		fv.SetInt(i)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		u, err := strconv.ParseUint(value, 10, fv.Type().Bits())
+		if err != nil {
+			return errors.Unwrap(err)
+		}
+		fv.SetUint(u)
+	case reflect.Float32, reflect.Float64:
+		f, err := strconv.ParseFloat(value, fv.Type().Bits())
+		if err != nil {
+			return errors.Unwrap(err)
+		}
+		fv.SetFloat(f)
+	case reflect.Slice:
+		items := strings.Split(value, ",")
+		slice := reflect.MakeSlice(fv.Type(), len(items), len(items))
+		for i, item := range items {
+			err := setValue(slice.Index(i), strings.TrimSpace(item))
+			if err != nil {
+				return err
+			}
+		}
+		fv.Set(slice)
+	default:
+		return fmt.Errorf("unsupported type %s", fv.Type())
+	}
+	return nil
+}
+
+// parseDuration parses a duration like 5s, or a number of seconds.
+func parseDuration(value string) (time.Duration, error) {
+	seconds, err := strconv.Atoi(value)
+	if err == nil {
+		return time.Duration(seconds) * time.Second, nil
+	}
+	return time.ParseDuration(value)
+}
+
+// parseBool parses yes, true or 1 as true, and no, false or 0 as false.
+func parseBool(value string) (bool, error) {
+	switch strings.ToLower(strings.TrimSpace(value)) {
+	case "yes", "true", "1":
+		return true, nil
+	case "no", "false", "0":
+		return false, nil
+	}
+	return false, errors.New("expected yes, no, true, false, 1 or 0")
+}
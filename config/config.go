@@ -1,12 +1,13 @@
-// Package config offers utilities for parsing a json config file.
+// Package config offers utilities for parsing a json, yaml, toml or .env config file.
 // Values are read as strings, and can be fetched with Get, GetInt or GetBool.
 // The caller is expected to parse them for more complex types.
+// Values may be overridden by env variables, see EnvKey.
 package config
 
 import (
-	"encoding/json"
+	"errors"
 	"fmt"
-	"io/ioutil"
+	"os"
 	"strconv"
 )
 
@@ -15,7 +16,9 @@ const (
 	DefaultPath = "secrets/fragmenta.json"
 )
 
-// Config modes are set when creating a new config
+// Config modes are set when creating a new config, they are kept for
+// compatibility, as each environment has the mode of the environment it
+// extends, or production if it extends none (see SetEnv).
 const (
 	ModeDevelopment = iota
 	ModeProduction
@@ -25,74 +28,107 @@ const (
 // Current is the current configuration object for
 var Current *Config
 
-// Config represents a set of key/value pairs for each mode of the app,
-// production, development and test. Which set of values is used
-// is set by Mode.
+// Config represents a set of key/value pairs for each environment of the
+// app, e.g. development, staging, production and test. Which set of
+// values is used is set by SetEnv, or by setting Mode for the environment
+// of the same name. Values loaded from file may be overridden by env
+// variables (see EnvKey), which may in turn be overridden with Set.
 type Config struct {
-	Mode    int
-	configs []map[string]string
+	Mode int
+
+	// env is the name of the environment selected
+	env string
+
+	// envMode is the Mode when env was selected, to detect Mode being set directly
+	envMode int
+
+	// configs are the values for each environment, with inherited values set
+	configs map[string]map[string]string
+
+	// parents are the names of the environments each environment extends
+	parents map[string]string
+
+	overrides map[string]string
 }
 
-// New returns a new config, which defaults to development
+// New returns a new config, for the environment named by FRAG_ENV,
+// which defaults to development
 func New() *Config {
-	return &Config{
-		Mode:    ModeDevelopment,
-		configs: make([]map[string]string, 3),
-	}
+	c := &Config{}
+	c.SetEnv(EnvName())
+	return c
 }
 
-// Load our json config file from the path
+// Load our config file from the path, which may be json, yaml, toml or
+// .env, as chosen by the file extension (see RegisterFormat).
 func (c *Config) Load(path string) error {
 
-	// Read the config json file
-	file, err := ioutil.ReadFile(path)
+	decode, err := decoderFor(path)
 	if err != nil {
-		return fmt.Errorf("error opening config %s %v", path, err)
+		return err
 	}
 
-	var data map[string]map[string]string
-	err = json.Unmarshal(file, &data)
+	// Read the config file
+	file, err := os.ReadFile(path)
 	if err != nil {
-		return fmt.Errorf("error reading config %s %v", path, err)
+		return fmt.Errorf("error opening config %s %v", path, err)
 	}
 
-	if len(data) < 3 {
-		return fmt.Errorf("error reading config - not enough configs, got :%d expected 3", len(data))
+	data, err := decode(file)
+	if err != nil {
+		var parseErr *ParseError
+		if errors.As(err, &parseErr) {
+			parseErr.Path = path
+			return parseErr
+		}
+		return &ParseError{Path: path, Err: err}
 	}
 
-	c.configs[ModeDevelopment] = data["development"]
-	c.configs[ModeProduction] = data["production"]
-	c.configs[ModeTest] = data["test"]
+	configs, parents, err := resolveEnvs(data)
+	if err != nil {
+		return fmt.Errorf("error reading config %s %v", path, err)
+	}
+	c.configs = configs
+	c.parents = parents
 
-	return nil
+	// Update the mode from the environments loaded, and check
+	// that there are values for the environment selected
+	return c.SetEnv(c.Env())
 }
 
 // Production returns true if current config is production.
 func (c *Config) Production() bool {
-	return c.Mode == ModeProduction
+	return c != nil && c.Mode == ModeProduction
 }
 
 // Development returns true if current config is development.
 func (c *Config) Development() bool {
-	return c.Mode == ModeDevelopment
+	return c != nil && c.Mode == ModeDevelopment
 }
 
 // Testing returns true if current config is test.
 func (c *Config) Testing() bool {
-	return c.Mode == ModeTest
+	return c != nil && c.Mode == ModeTest
 }
 
-// Configuration returns all the configuration key/values for a given mode.
+// Configuration returns all the configuration key/values for the current
+// environment, with env variables and overrides applied. The map returned
+// is a copy, so changing it no longer changes the config, use Set instead.
 func (c *Config) Configuration(m int) map[string]string {
-	return c.configs[c.Mode]
+	values := make(map[string]string)
+	for key := range c.values() {
+		values[key] = c.Get(key)
+	}
+	for key, value := range c.overrides {
+		values[key] = value
+	}
+	return values
 }
 
 // Get returns a specific value or "" if no value
 func (c *Config) Get(key string) string {
-	if c == nil {
-		return ""
-	}
-	return c.configs[c.Mode][key]
+	v, _ := c.lookup(key)
+	return v
 }
 
 // GetInt returns the current configuration value as int64, or 0 if no value
@@ -108,10 +144,10 @@ func (c *Config) GetInt(key string) int64 {
 }
 
 // GetBool returns the current configuration value as bool
-// (yes=true, no=false), or false if no value
+// (yes/true/1=true, no/false/0=false), or false if no value
 func (c *Config) GetBool(key string) bool {
-	v := c.Get(key)
-	return (v == "yes")
+	b, _ := parseBool(c.Get(key))
+	return b
 }
 
 // Config (Get) returns a specific value or "" if no value
@@ -121,21 +157,22 @@ func (c *Config) Config(key string) string {
 	return c.Get(key)
 }
 
-// These convenience functions wrap the Current pkg global
+// These convenience functions wrap the Current pkg global,
+// which may be nil if no config has been loaded
 
 // Production returns true if current config is production.
 func Production() bool {
-	return Current.Mode == ModeProduction
+	return Current.Production()
 }
 
 // Development returns true if the config is Development
 func Development() bool {
-	return Current.Mode == ModeDevelopment
+	return Current.Development()
 }
 
 // Testing returns true if the config is not Test or Production
 func Testing() bool {
-	return Current.Mode == ModeTest
+	return Current.Testing()
 }
 
 // Configuration returns all the configuration key/values for a given mode.
@@ -154,7 +191,12 @@ func GetInt(key string) int64 {
 }
 
 // GetBool returns the current configuration value as bool
-// (yes=true, no=false), or false if no value
+// (yes/true/1=true, no/false/0=false), or false if no value
 func GetBool(key string) bool {
 	return Current.GetBool(key)
 }
+
+// Set sets an explicit override for key on the current config
+func Set(key, value string) {
+	Current.Set(key, value)
+}
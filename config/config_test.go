@@ -1,7 +1,14 @@
 package config
 
 import (
+	"errors"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
 	"testing"
+	"time"
 )
 
 // TestLoad tests load of broken json
@@ -21,11 +28,18 @@ func TestLoadBroken(t *testing.T) {
 		t.Fatalf("config failed to load valid json")
 	}
 
-	// This should not load as it does not have all configs
-	// which could lead to issues with wrong config being used.
+	// This should load as it has the development config
+	c = New()
 	err = c.Load("testdata/single.json")
-	if err == nil {
-		t.Fatalf("config did not error on single json")
+	if err != nil {
+		t.Fatalf("config failed to load single json %s", err)
+	}
+
+	// This should not select production as it has no production config
+	// which could lead to issues with wrong config being used.
+	err = c.SetEnv("production")
+	if err == nil || c.Env() != "development" {
+		t.Fatalf("config did not error on missing environment")
 	}
 
 }
@@ -69,3 +83,231 @@ func TestConfig(t *testing.T) {
 		t.Fatalf("config failed to get all")
 	}
 }
+
+// TestOverlays tests env variables and overrides take precedence over file values
+func TestOverlays(t *testing.T) {
+	c := New()
+	err := c.Load("testdata/config.json")
+	if err != nil {
+		t.Fatalf("config failed to load valid json")
+	}
+
+	if c.Get("db_pass") != "secret" || c.Source("db_pass") != SourceFile {
+		t.Fatalf("config failed to load db_pass from file got:%s", c.Source("db_pass"))
+	}
+
+	t.Setenv("FRAG_DB_PASS", "env")
+	if c.Get("db_pass") != "env" || c.Source("db_pass") != SourceEnv {
+		t.Fatalf("config failed to read db_pass from env got:%s", c.Get("db_pass"))
+	}
+	if c.Configuration(c.Mode)["db_pass"] != "env" {
+		t.Fatalf("config failed to apply env to configuration")
+	}
+
+	// The configuration returned is a copy
+	c.Configuration(c.Mode)["db_user"] = "changed"
+	if c.Get("db_user") != "server" {
+		t.Fatalf("config changed by writing to configuration got:%s", c.Get("db_user"))
+	}
+
+	c.Set("db_pass", "override")
+	if c.Get("db_pass") != "override" || c.Source("db_pass") != SourceOverride {
+		t.Fatalf("config failed to override db_pass got:%s", c.Get("db_pass"))
+	}
+
+	if c.Source("missing") != SourceNone || c.Get("missing") != "" {
+		t.Fatalf("config found missing key")
+	}
+	if EnvKey("server.read-timeout") != "FRAG_SERVER_READ_TIMEOUT" {
+		t.Fatalf("config wrong env key got:%s", EnvKey("server.read-timeout"))
+	}
+}
+
+// TestInterpolate tests ${VAR} references are replaced by env variables
+func TestInterpolate(t *testing.T) {
+	t.Setenv("DB_HOST", "db.example.com")
+	t.Setenv("DB_EMPTY", "")
+
+	tests := map[string]string{
+		"plain":                              "plain",
+		"pa$word":                            "pa$word",
+		"${DB_HOST}:5432":                    "db.example.com:5432",
+		"${DB_EMPTY:-localhost}":             "localhost",
+		"${DB_UNSET:-local:host}/${DB_HOST}": "local:host/db.example.com",
+		"${DB_UNSET}":                        "",
+		"${unterminated":                     "${unterminated",
+	}
+	for value, expected := range tests {
+		if got := Interpolate(value); got != expected {
+			t.Fatalf("config wrong interpolation for %s expected:%s got:%s", value, expected, got)
+		}
+	}
+}
+
+// TestFormats tests loading yaml, toml and .env files
+func TestFormats(t *testing.T) {
+	for _, path := range []string{"testdata/config.yaml", "testdata/config.toml", "testdata/config.env"} {
+		c := New()
+		err := c.Load(path)
+		if err != nil {
+			t.Fatalf("config failed to load %s %s", path, err)
+		}
+		if c.GetInt("port") != 3000 || c.Get("hosts") != "a.example.com,b.example.com" {
+			t.Fatalf("config wrong values for %s got:%v", path, c.Configuration(c.Mode))
+		}
+		if path == "testdata/config.env" && (c.Get("db_pass") != `sec"ret` || c.Get("mail_from") != "me@example.com" || c.Get("session_name") != "app") {
+			t.Fatalf("config wrong quoted values got:%v", c.Configuration(c.Mode))
+		}
+	}
+}
+
+// TestParseErrors tests parse errors report the line at fault
+func TestParseErrors(t *testing.T) {
+	tests := map[string]string{
+		"bad.json":  "{\n\"development\": {\n\"port\": 3000\n}}",
+		"bad.yaml":  "development:\n  port: 3000\n  nested:\n    key: value\n",
+		"bad.toml":  "[development]\nport = 3000\nhost = \n",
+		"bad2.toml": "[development]\nport = 3000\nnested = {a = 1}\n",
+		"bad3.toml": "[development]\nhosts = [[\"a\"]]\n",
+		"bad4.toml": "# app\nport = 3000\n",
+		"bad.env":   "PORT=3000\nnot a key value\n",
+		"bad2.env":  "PORT=3000\nKEY=\"v\" trailing \"text\"\n",
+	}
+	dir := t.TempDir()
+	for name, data := range tests {
+		path := filepath.Join(dir, name)
+		os.WriteFile(path, []byte(data), 0600)
+		err := New().Load(path)
+		var parseErr *ParseError
+		if !errors.As(err, &parseErr) || parseErr.Line < 2 || !strings.Contains(err.Error(), path) {
+			t.Fatalf("config wrong error for %s got:%v", name, err)
+		}
+	}
+
+	err := New().Load("testdata/config.ini")
+	if err == nil {
+		t.Fatalf("config did not error on unknown format")
+	}
+}
+
+// TestBind tests binding config values to a struct
+func TestBind(t *testing.T) {
+	type mail struct {
+		From   string `config:"from,required"`
+		Secret string `config:"secret"`
+	}
+	type appConfig struct {
+		DBUser   string        `config:"db_user,required"`
+		Port     int           `config:"port"`
+		Compiled bool          `config:"assets_compiled"`
+		Timeout  time.Duration `config:"timeout" default:"5s"`
+		Idle     time.Duration `config:"idle" default:"30"`
+		Ratio    float64       `config:"ratio" default:"0.5"`
+		Hosts    []string      `config:"hosts" default:"a.com, b.com"`
+		Ports    []int         `config:"ports" default:"80,443"`
+		RootURL  *url.URL      `config:"root_url"`
+		Mail     mail          `config:"mail"`
+		Ignored  string
+	}
+
+	c := New()
+	err := c.Load("testdata/config.json")
+	if err != nil {
+		t.Fatalf("config failed to load valid json")
+	}
+	c.Set("assets_compiled", "true")
+	if !c.GetBool("assets_compiled") {
+		t.Fatalf("config failed to read true as bool")
+	}
+
+	var app appConfig
+	err = c.Bind(&app)
+	if err != nil {
+		t.Fatalf("config failed to bind %s", err)
+	}
+	if app.DBUser != "server" || app.Port != 3000 || !app.Compiled || app.Timeout != 5*time.Second || app.Idle != 30*time.Second {
+		t.Fatalf("config wrong values bound got:%+v", app)
+	}
+	if app.Ratio != 0.5 || len(app.Hosts) != 2 || app.Hosts[1] != "b.com" || app.Ports[1] != 443 {
+		t.Fatalf("config wrong defaults bound got:%+v", app)
+	}
+	if app.RootURL.Host != "localhost:3000" || app.Mail.From != "example@example.com" || app.Mail.Secret != "secret" {
+		t.Fatalf("config wrong nested values bound got:%+v", app)
+	}
+
+	// All missing and invalid keys are reported
+	c.Set("port", "eighty")
+	c.Set("db_user", "")
+	c.Set("mail_from", "")
+	err = c.Bind(&app)
+	for _, key := range []string{"db_user", "port", "mail_from"} {
+		if err == nil || !strings.Contains(err.Error(), key) {
+			t.Fatalf("config error missing %s got:%v", key, err)
+		}
+	}
+
+	if c.Bind(app) == nil {
+		t.Fatalf("config did not error on non pointer")
+	}
+}
+
+// TestEnvironments tests named environments inherit from default and extends
+func TestEnvironments(t *testing.T) {
+	t.Setenv(EnvVar, "staging")
+
+	c := New()
+	err := c.Load("testdata/envs.json")
+	if err != nil {
+		t.Fatalf("config failed to load envs %s", err)
+	}
+
+	// Staging extends production, which inherits from default
+	if c.Env() != "staging" || !c.Production() {
+		t.Fatalf("config wrong environment got:%s mode:%d", c.Env(), c.Mode)
+	}
+	if c.Get("root_url") != "https://staging.example.com" || c.Get("port") != "80" || c.Get("db_user") != "server" {
+		t.Fatalf("config wrong staging values got:%v", c.Configuration(c.Mode))
+	}
+	if c.Get(ExtendsKey) != "" {
+		t.Fatalf("config extends key in values")
+	}
+
+	// Development inherits from default only
+	err = c.SetEnv("development")
+	if err != nil || c.Production() || c.Get("port") != "3000" || c.Get("db_user") != "server" {
+		t.Fatalf("config wrong development values got:%v", c.Configuration(c.Mode))
+	}
+
+	// Setting the mode directly selects the environment of that name
+	c.Mode = ModeTest
+	if c.Env() != "test" || c.Get("db") != "test_db" {
+		t.Fatalf("config mode did not select environment got:%s", c.Env())
+	}
+
+	// Environments which don't extend development are production, even
+	// if they are unknown, so that development details are not shown
+	for _, name := range []string{"prod", "preview"} {
+		err = c.SetEnv(name)
+		if err != nil || !c.Production() {
+			t.Fatalf("config wrong mode for %s got:%d err:%v", name, c.Mode, err)
+		}
+	}
+
+	expected := []string{"development", "production", "staging", "test"}
+	if !reflect.DeepEqual(c.Envs(), expected) {
+		t.Fatalf("config wrong environments got:%v", c.Envs())
+	}
+
+	// Environments which extend unknown environments or themselves are invalid
+	dir := t.TempDir()
+	for name, data := range map[string]string{
+		"unknown.json":  `{"staging": {"extends": "production"}}`,
+		"circular.json": `{"a": {"extends": "b"}, "b": {"extends": "a"}}`,
+	} {
+		path := filepath.Join(dir, name)
+		os.WriteFile(path, []byte(data), 0600)
+		if New().Load(path) == nil {
+			t.Fatalf("config did not error on %s", name)
+		}
+	}
+}
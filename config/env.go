@@ -0,0 +1,114 @@
+package config
+
+import (
+	"os"
+	"strings"
+)
+
+// EnvPrefix is prepended to upper case keys to find env variables
+// which override config values, e.g. FRAG_DB_PASS overrides db_pass.
+const EnvPrefix = "FRAG_"
+
+// Source describes where a config value came from.
+type Source int
+
+// Sources of config values, in order of precedence.
+const (
+	SourceNone Source = iota
+	SourceFile
+	SourceEnv
+	SourceOverride
+)
+
+// String returns the name of the source.
+func (s Source) String() string {
+	switch s {
+	case SourceFile:
+		return "file"
+	case SourceEnv:
+		return "env"
+	case SourceOverride:
+		return "override"
+	}
+	return "none"
+}
+
+// EnvKey returns the name of the env variable which overrides key,
+// e.g. FRAG_DB_PASS for db_pass.
+func EnvKey(key string) string {
+	return EnvPrefix + strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z':
+			return r - 'a' + 'A'
+		case r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+			return r
+		}
+		return '_'
+	}, key)
+}
+
+// Set sets an explicit override for key, which takes precedence over
+// env variables and values loaded from file in every mode.
+func (c *Config) Set(key, value string) {
+	if c.overrides == nil {
+		c.overrides = make(map[string]string)
+	}
+	c.overrides[key] = value
+}
+
+// Source returns the source of the value for key.
+func (c *Config) Source(key string) Source {
+	_, source := c.lookup(key)
+	return source
+}
+
+// lookup returns the value for key and its source, from overrides, then
+// env variables, then the file loaded for the current environment, with
+// ${VAR} references in values from file replaced by env variables.
+func (c *Config) lookup(key string) (string, Source) {
+	if c == nil {
+		return "", SourceNone
+	}
+	if v, ok := c.overrides[key]; ok {
+		return v, SourceOverride
+	}
+	if v, ok := os.LookupEnv(EnvKey(key)); ok {
+		return v, SourceEnv
+	}
+	if v, ok := c.values()[key]; ok {
+		return Interpolate(v), SourceFile
+	}
+	return "", SourceNone
+}
+
+// Interpolate replaces ${VAR} in value with the env variable VAR, and
+// ${VAR:-default} with the default if VAR is unset or empty.
+// A $ which is not followed by { is left unchanged.
+func Interpolate(value string) string {
+	if !strings.Contains(value, "${") {
+		return value
+	}
+	var b strings.Builder
+	for {
+		start := strings.Index(value, "${")
+		if start < 0 {
+			break
+		}
+		end := strings.IndexByte(value[start:], '}')
+		if end < 0 {
+			break
+		}
+		end += start
+		b.WriteString(value[:start])
+
+		name, fallback, hasFallback := strings.Cut(value[start+2:end], ":-")
+		v := os.Getenv(name)
+		if v == "" && hasFallback {
+			v = fallback
+		}
+		b.WriteString(v)
+		value = value[end+1:]
+	}
+	b.WriteString(value)
+	return b.String()
+}
@@ -0,0 +1,166 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"sort"
+)
+
+// EnvVar is the env variable which names the environment to use,
+// it is read by New and by server.New.
+const EnvVar = "FRAG_ENV"
+
+// DefaultEnv is the environment used if EnvVar is not set.
+const DefaultEnv = "development"
+
+// DefaultSection is the section of the config file whose values are
+// inherited by every environment.
+const DefaultSection = "default"
+
+// ExtendsKey is the key in an environment which names the environment
+// it inherits values from, e.g. "extends": "production" for staging.
+const ExtendsKey = "extends"
+
+// modeNames are the names of the environments for each mode.
+var modeNames = []string{
+	ModeDevelopment: "development",
+	ModeProduction:  "production",
+	ModeTest:        "test",
+}
+
+// EnvName returns the name of the environment set by EnvVar,
+// or DefaultEnv if it is not set.
+func EnvName() string {
+	name := os.Getenv(EnvVar)
+	if name == "" {
+		return DefaultEnv
+	}
+	return name
+}
+
+// Env returns the name of the environment selected.
+func (c *Config) Env() string {
+	if c == nil {
+		return ""
+	}
+	// Setting Mode directly selects the environment of that name
+	if c.env == "" || c.Mode != c.envMode {
+		if c.Mode >= 0 && c.Mode < len(modeNames) {
+			return modeNames[c.Mode]
+		}
+	}
+	return c.env
+}
+
+// SetEnv selects the environment named, and sets Mode to the mode of
+// the environment (see modeFor). If a config has been loaded which has
+// no values for the environment and no default section, it returns an
+// error, so that the wrong config is not used.
+func (c *Config) SetEnv(name string) error {
+	if c.configs != nil {
+		_, ok := c.configs[name]
+		if !ok && c.configs[DefaultSection] == nil {
+			return fmt.Errorf("error selecting config environment %s, environments are %v", name, c.Envs())
+		}
+	}
+	c.env = name
+	c.Mode = c.modeFor(name)
+	c.envMode = c.Mode
+	return nil
+}
+
+// Envs returns the sorted names of the environments loaded.
+func (c *Config) Envs() []string {
+	var names []string
+	for name := range c.configs {
+		if name != DefaultSection {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// modeFor returns the mode for the environment named, development,
+// production and test have their own modes, and other environments have
+// the mode of the environment they extend, or production, so that an
+// unknown environment never shows development details.
+func (c *Config) modeFor(name string) int {
+	for range len(c.parents) + 1 {
+		for mode, modeName := range modeNames {
+			if name == modeName {
+				return mode
+			}
+		}
+		parent, ok := c.parents[name]
+		if !ok {
+			break
+		}
+		name = parent
+	}
+	return ModeProduction
+}
+
+// values returns the values for the environment selected, or the
+// default section if there is no section for the environment.
+func (c *Config) values() map[string]string {
+	values, ok := c.configs[c.Env()]
+	if !ok {
+		return c.configs[DefaultSection]
+	}
+	return values
+}
+
+// resolveEnvs returns the values for each environment in the sections given,
+// with values inherited from the environments they extend and from the
+// default section, and the environment each extends.
+func resolveEnvs(sections map[string]map[string]string) (map[string]map[string]string, map[string]string, error) {
+	parents := make(map[string]string)
+	for name, section := range sections {
+		parent, ok := section[ExtendsKey]
+		if !ok {
+			continue
+		}
+		if name == DefaultSection {
+			return nil, nil, fmt.Errorf("the %s section can't extend %s", DefaultSection, parent)
+		}
+		if _, ok := sections[parent]; !ok || parent == DefaultSection {
+			return nil, nil, fmt.Errorf("environment %s extends unknown environment %s", name, parent)
+		}
+		parents[name] = parent
+	}
+
+	configs := make(map[string]map[string]string)
+	for name := range sections {
+		// Collect the chain of environments from this one to the root
+		chain := []string{name}
+		for parent, ok := parents[name]; ok; parent, ok = parents[parent] {
+			if len(chain) > len(sections) || parent == name {
+				return nil, nil, fmt.Errorf("environment %s extends itself", name)
+			}
+			chain = append(chain, parent)
+		}
+
+		// Apply the default section, then each environment from the root
+		values := make(map[string]string)
+		if name != DefaultSection {
+			for k, v := range sections[DefaultSection] {
+				values[k] = v
+			}
+		}
+		for i := len(chain) - 1; i >= 0; i-- {
+			for k, v := range sections[chain[i]] {
+				values[k] = v
+			}
+		}
+		delete(values, ExtendsKey)
+		configs[name] = values
+	}
+
+	// The default section alone applies to any environment
+	if _, ok := configs[DefaultSection]; !ok {
+		configs[DefaultSection] = nil
+	}
+
+	return configs, parents, nil
+}
@@ -0,0 +1,348 @@
+package config
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+// Decoder decodes config file data into key/values by section name
+// (default, development, production, test or other environments).
+type Decoder func(data []byte) (map[string]map[string]string, error)
+
+// ParseError is returned by Load for a config file which can't be decoded,
+// Line is the line in the file at fault, or 0 if it is not known.
+type ParseError struct {
+	Path string
+	Line int
+	Err  error
+}
+
+// Error returns the path and line of the error, and the error.
+func (e *ParseError) Error() string {
+	if e.Line > 0 {
+		return fmt.Sprintf("error reading config %s line %d: %v", e.Path, e.Line, e.Err)
+	}
+	return fmt.Sprintf("error reading config %s: %v", e.Path, e.Err)
+}
+
+// Unwrap returns the underlying error.
+func (e *ParseError) Unwrap() error {
+	return e.Err
+}
+
+var (
+	formatsMu sync.RWMutex
+
+	// formats are the decoders registered by file extension
+	formats = map[string]Decoder{
+		".json": DecodeJSON,
+		".yaml": DecodeYAML,
+		".yml":  DecodeYAML,
+		".toml": DecodeTOML,
+		".env":  DecodeDotenv,
+	}
+)
+
+// RegisterFormat registers the decoder used by Load for files with the
+// extension given (e.g. .yaml), replacing any existing decoder.
+func RegisterFormat(ext string, d Decoder) {
+	formatsMu.Lock()
+	defer formatsMu.Unlock()
+	formats[strings.ToLower(ext)] = d
+}
+
+// decoderFor returns the decoder for the path from its extension.
+func decoderFor(path string) (Decoder, error) {
+	formatsMu.RLock()
+	defer formatsMu.RUnlock()
+	ext := strings.ToLower(filepath.Ext(path))
+	d, ok := formats[ext]
+	if !ok {
+		return nil, fmt.Errorf("error reading config %s: unknown format %s", path, ext)
+	}
+	return d, nil
+}
+
+// DecodeJSON decodes a json object of sections containing string values.
+func DecodeJSON(data []byte) (map[string]map[string]string, error) {
+	var values map[string]map[string]string
+	err := json.Unmarshal(data, &values)
+	if err != nil {
+		var syntaxErr *json.SyntaxError
+		var typeErr *json.UnmarshalTypeError
+		switch {
+		case errors.As(err, &syntaxErr):
+			return nil, &ParseError{Line: lineAt(data, syntaxErr.Offset), Err: err}
+		case errors.As(err, &typeErr):
+			return nil, &ParseError{Line: lineAt(data, typeErr.Offset), Err: err}
+		}
+		return nil, &ParseError{Err: err}
+	}
+	return values, nil
+}
+
+// DecodeYAML decodes a yaml mapping of sections containing scalar values,
+// lists of scalars are joined with commas.
+func DecodeYAML(data []byte) (map[string]map[string]string, error) {
+	var doc yaml.Node
+	err := yaml.Unmarshal(data, &doc)
+	if err != nil {
+		return nil, &ParseError{Line: yamlErrorLine(err), Err: err}
+	}
+	values := make(map[string]map[string]string)
+	if len(doc.Content) == 0 {
+		return values, nil
+	}
+
+	root := doc.Content[0]
+	if root.Kind != yaml.MappingNode {
+		return nil, &ParseError{Line: root.Line, Err: errors.New("expected a mapping of sections")}
+	}
+	for i := 0; i+1 < len(root.Content); i += 2 {
+		name, section := root.Content[i], root.Content[i+1]
+		if section.Kind != yaml.MappingNode {
+			return nil, &ParseError{Line: section.Line, Err: fmt.Errorf("section %s must be a mapping", name.Value)}
+		}
+		values[name.Value] = make(map[string]string)
+		for j := 0; j+1 < len(section.Content); j += 2 {
+			key, value := section.Content[j], section.Content[j+1]
+			v, err := yamlValue(value)
+			if err != nil {
+				return nil, &ParseError{Line: value.Line, Err: fmt.Errorf("%s.%s %v", name.Value, key.Value, err)}
+			}
+			values[name.Value][key.Value] = v
+		}
+	}
+	return values, nil
+}
+
+// yamlValue returns the string value of a scalar or list of scalars.
+func yamlValue(node *yaml.Node) (string, error) {
+	switch node.Kind {
+	case yaml.ScalarNode:
+		if node.Tag == "!!null" {
+			return "", nil
+		}
+		return node.Value, nil
+	case yaml.SequenceNode:
+		var items []string
+		for _, item := range node.Content {
+			if item.Kind != yaml.ScalarNode {
+				return "", errors.New("must be a list of values")
+			}
+			items = append(items, item.Value)
+		}
+		return strings.Join(items, ","), nil
+	case yaml.AliasNode:
+		return yamlValue(node.Alias)
+	}
+	return "", errors.New("must be a value or a list of values")
+}
+
+// yamlErrorLine returns the line reported in a yaml syntax error, or 0.
+// Errors in values are reported from node lines instead, this is used
+// only for syntax errors, which yaml.v3 reports without a position.
+func yamlErrorLine(err error) int {
+	var line int
+	_, scanErr := fmt.Sscanf(err.Error(), "yaml: line %d:", &line)
+	if scanErr != nil {
+		return 0
+	}
+	return line
+}
+
+// DecodeTOML decodes toml tables of sections containing values,
+// arrays of values are joined with commas.
+func DecodeTOML(data []byte) (map[string]map[string]string, error) {
+	var doc map[string]toml.Primitive
+	md, err := toml.Decode(string(data), &doc)
+	if err != nil {
+		var parseErr toml.ParseError
+		if errors.As(err, &parseErr) {
+			return nil, &ParseError{Line: parseErr.Position.Line, Err: errors.New(parseErr.Message)}
+		}
+		return nil, &ParseError{Err: err}
+	}
+
+	// Sections are decoded from their primitives so that errors in them
+	// are reported with the line of the key at fault
+	values := make(map[string]map[string]string)
+	for name, prim := range doc {
+		var section map[string]tomlString
+		err = md.PrimitiveDecode(prim, &tomlTable{})
+		if err == nil {
+			err = md.PrimitiveDecode(prim, &section)
+		}
+		if err != nil {
+			var parseErr toml.ParseError
+			if errors.As(err, &parseErr) {
+				return nil, &ParseError{Line: parseErr.Position.Line, Err: fmt.Errorf("%s %s", parseErr.LastKey, parseErr.Message)}
+			}
+			return nil, &ParseError{Err: err}
+		}
+		values[name] = make(map[string]string)
+		for key, value := range section {
+			values[name][key] = string(value)
+		}
+	}
+	return values, nil
+}
+
+// tomlTable checks a toml section is a table when decoded.
+type tomlTable struct{}
+
+// UnmarshalTOML returns an error if data is not a table.
+func (t *tomlTable) UnmarshalTOML(data any) error {
+	if _, ok := data.(map[string]any); !ok {
+		return errors.New("must be a table")
+	}
+	return nil
+}
+
+// tomlString is a toml value or array of values decoded as a string.
+type tomlString string
+
+// UnmarshalTOML sets the string value of data.
+func (s *tomlString) UnmarshalTOML(data any) error {
+	v, err := tomlValue(data)
+	if err != nil {
+		return err
+	}
+	*s = tomlString(v)
+	return nil
+}
+
+// tomlValue returns the string value of a toml value or array of values.
+func tomlValue(value any) (string, error) {
+	switch v := value.(type) {
+	case string:
+		return v, nil
+	case int64:
+		return strconv.FormatInt(v, 10), nil
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), nil
+	case bool:
+		return strconv.FormatBool(v), nil
+	case time.Time:
+		return v.Format(time.RFC3339Nano), nil
+	case []any:
+		var items []string
+		for _, item := range v {
+			if _, ok := item.([]any); ok {
+				return "", errors.New("must be an array of values")
+			}
+			s, err := tomlValue(item)
+			if err != nil {
+				return "", err
+			}
+			items = append(items, s)
+		}
+		return strings.Join(items, ","), nil
+	}
+	return "", errors.New("must be a value or an array of values")
+}
+
+// DecodeDotenv decodes KEY=value lines into the default section,
+// so that they set values for every environment.
+// Keys are lower cased with any FRAG_ prefix removed, so that DB_PASS or
+// FRAG_DB_PASS sets db_pass. Values may be quoted, and lines starting
+// with # are ignored.
+func DecodeDotenv(data []byte) (map[string]map[string]string, error) {
+	env := make(map[string]string)
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	line := 0
+	for scanner.Scan() {
+		line++
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		text = strings.TrimPrefix(text, "export ")
+
+		key, value, ok := strings.Cut(text, "=")
+		key = strings.TrimSpace(key)
+		if !ok || key == "" || strings.ContainsAny(key, " \t") {
+			return nil, &ParseError{Line: line, Err: fmt.Errorf("expected KEY=value got %q", text)}
+		}
+		value, err := dotenvValue(strings.TrimSpace(value))
+		if err != nil {
+			return nil, &ParseError{Line: line, Err: fmt.Errorf("%s %v", key, err)}
+		}
+		key = strings.ToLower(strings.TrimPrefix(key, EnvPrefix))
+		env[key] = value
+	}
+	err := scanner.Err()
+	if err != nil {
+		return nil, &ParseError{Line: line + 1, Err: err}
+	}
+
+	return map[string]map[string]string{DefaultSection: env}, nil
+}
+
+// dotenvValue returns the value with quotes and comments removed.
+// Escapes are replaced in double quoted values only.
+func dotenvValue(value string) (string, error) {
+	if value == "" {
+		return "", nil
+	}
+	switch quote := value[0]; quote {
+	case '"', '\'':
+		end := closingQuote(value)
+		if end < 0 {
+			return "", errors.New("has an unterminated quote")
+		}
+		rest := strings.TrimSpace(value[end+1:])
+		if rest != "" && !strings.HasPrefix(rest, "#") {
+			return "", fmt.Errorf("has unexpected text after quote %q", rest)
+		}
+		if quote == '\'' {
+			return value[1:end], nil
+		}
+		v, err := strconv.Unquote(value[:end+1])
+		if err != nil {
+			return "", errors.New("has an invalid escape")
+		}
+		return v, nil
+	}
+	// Unquoted values end at a comment
+	if i := strings.Index(value, " #"); i >= 0 {
+		value = strings.TrimSpace(value[:i])
+	}
+	return value, nil
+}
+
+// closingQuote returns the index of the quote closing the quoted value,
+// skipping escaped quotes in double quoted values, or -1 if there is none.
+func closingQuote(value string) int {
+	quote := value[0]
+	for i := 1; i < len(value); i++ {
+		switch value[i] {
+		case '\\':
+			if quote == '"' {
+				i++
+			}
+		case quote:
+			return i
+		}
+	}
+	return -1
+}
+
+// lineAt returns the line number of the byte offset in data.
+func lineAt(data []byte, offset int64) int {
+	if offset > int64(len(data)) {
+		offset = int64(len(data))
+	}
+	return bytes.Count(data[:offset], []byte("\n")) + 1
+}
@@ -1,13 +1,13 @@
 package server
 
 import (
-	"encoding/json"
 	"flag"
 	"fmt"
-	"io/ioutil"
 	"os"
 	"strconv"
 	"time"
+
+	"github.com/fragmenta/server/config"
 )
 
 // Deprecated - use server/log pkg instead to log
@@ -74,7 +74,12 @@ func (s *Server) Production() bool {
 }
 
 // Configuration returns the map of configuration keys to values
+// from the config set with WithConfig if any, or from the server configs.
+// Values from a config are a copy, use the config Set to change them.
 func (s *Server) Configuration() map[string]string {
+	if s.config != nil {
+		return s.config.Configuration(s.config.Mode)
+	}
 	if s.production {
 		return s.configProduction
 	}
@@ -84,6 +89,9 @@ func (s *Server) Configuration() map[string]string {
 
 // Config returns a specific configuration value or "" if no value
 func (s *Server) Config(key string) string {
+	if s.config != nil {
+		return s.config.Get(key)
+	}
 	return s.Configuration()[key]
 }
 
@@ -107,29 +115,20 @@ func (s *Server) ConfigBool(key string) bool {
 
 // configPath returns our expected config file path
 func (s *Server) configPath() string {
-	return "secrets/fragmenta.json"
+	return config.DefaultPath
 }
 
 // Read our config file and set up the server accordingly
 func (s *Server) readConfig() error {
 
-	path := s.configPath()
-
-	// Read the config json file
-	file, err := ioutil.ReadFile(path)
-	if err != nil {
-		return fmt.Errorf("Error opening config %s %v", path, err)
+	if s.config == nil {
+		s.config = config.New()
 	}
-
-	var data map[string]map[string]string
-	err = json.Unmarshal(file, &data)
+	err := s.config.Load(s.configPath())
 	if err != nil {
-		return fmt.Errorf("Error reading config %s %v", path, err)
+		return err
 	}
-
-	s.configDevelopment = data["development"]
-	s.configProduction = data["production"]
-	s.configTest = data["test"]
+	s.production = s.config.Production()
 
 	// Update our port from the config port if we have it
 	portString := s.Config("port")
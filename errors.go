@@ -1,12 +1,22 @@
 package server
 
 import (
+	"errors"
 	"fmt"
 	"net/http"
 	"runtime"
+	"sort"
 	"strings"
+	"time"
 )
 
+// CaptureStack sets whether errors created by the constructors below
+// record the stack of their caller, which is useful in development.
+var CaptureStack = false
+
+// maxStackDepth is the maximum number of frames recorded by CaptureStack.
+const maxStackDepth = 32
+
 // StatusError wraps a std error and stores more information (status code, display title/msg and caller info)
 type StatusError struct {
 	Err     error
@@ -15,6 +25,15 @@ type StatusError struct {
 	Message string
 	File    string
 	Line    int
+
+	// Fields holds messages for invalid fields by field name
+	Fields map[string][]string
+
+	// RetryAfter is sent as the Retry-After header if set
+	RetryAfter time.Duration
+
+	// Stack is the stack of the caller, if CaptureStack is set
+	Stack []uintptr
 }
 
 // Error returns the underling error string - it should not be shown in production
@@ -27,13 +46,46 @@ func (e *StatusError) String() string {
 	return fmt.Sprintf("Status %d at %s : %s %s %s", e.Status, e.FileLine(), e.Title, e.Message, e.Err)
 }
 
+// Unwrap returns the underlying error, so that errors.Is and errors.As
+// can match it, e.g. errors.Is(err, sql.ErrNoRows)
+func (e *StatusError) Unwrap() error {
+	return e.Err
+}
+
+// Is returns true if target is a *StatusError with the same status
+// Usage: errors.Is(err, &server.StatusError{Status: http.StatusNotFound})
+func (e *StatusError) Is(target error) bool {
+	t, ok := target.(*StatusError)
+	return ok && t.Status == e.Status
+}
+
 // FileLine returns file name and line of error
 func (e *StatusError) FileLine() string {
 	parts := strings.Split(e.File, "/")
-	f := strings.Join(parts[len(parts)-4:len(parts)], "/")
+	if len(parts) > 4 {
+		parts = parts[len(parts)-4:]
+	}
+	f := strings.Join(parts, "/")
 	return fmt.Sprintf("%s:%d", f, e.Line)
 }
 
+// StackTrace returns the stack recorded if CaptureStack was set, one frame per line
+func (e *StatusError) StackTrace() string {
+	if len(e.Stack) == 0 {
+		return ""
+	}
+	var b strings.Builder
+	frames := runtime.CallersFrames(e.Stack)
+	for {
+		frame, more := frames.Next()
+		fmt.Fprintf(&b, "%s\n\t%s:%d\n", frame.Function, frame.File, frame.Line)
+		if !more {
+			break
+		}
+	}
+	return b.String()
+}
+
 func (e *StatusError) setupFromArgs(args ...string) *StatusError {
 	if e.Err == nil {
 		e.Err = fmt.Errorf("Error:%d", e.Status)
@@ -73,6 +125,54 @@ func BadRequestError(e error, args ...string) *StatusError {
 	return err.setupFromArgs(args...)
 }
 
+// ForbiddenError returns a new StatusError with Status StatusForbidden and optional Title and Message
+func ForbiddenError(e error, args ...string) *StatusError {
+	err := Error(e, http.StatusForbidden, "Forbidden", "Sorry, you don't have permission to do that.")
+	return err.setupFromArgs(args...)
+}
+
+// MethodNotAllowedError returns a new StatusError with Status StatusMethodNotAllowed and optional Title and Message
+func MethodNotAllowedError(e error, args ...string) *StatusError {
+	err := Error(e, http.StatusMethodNotAllowed, "Method Not Allowed", "Sorry, that method is not allowed here.")
+	return err.setupFromArgs(args...)
+}
+
+// ConflictError returns a new StatusError with Status StatusConflict and optional Title and Message
+func ConflictError(e error, args ...string) *StatusError {
+	err := Error(e, http.StatusConflict, "Conflict", "Sorry, your changes conflict with changes made by someone else.")
+	return err.setupFromArgs(args...)
+}
+
+// GoneError returns a new StatusError with Status StatusGone and optional Title and Message
+func GoneError(e error, args ...string) *StatusError {
+	err := Error(e, http.StatusGone, "Gone", "Sorry, the page you're looking for has been removed.")
+	return err.setupFromArgs(args...)
+}
+
+// UnprocessableEntityError returns a new StatusError with Status StatusUnprocessableEntity,
+// messages for invalid fields by field name, and optional Title and Message
+func UnprocessableEntityError(e error, fields map[string][]string, args ...string) *StatusError {
+	err := Error(e, http.StatusUnprocessableEntity, "Invalid Data", "Sorry, some of your data is invalid, please check the fields shown.")
+	err.Fields = fields
+	return err.setupFromArgs(args...)
+}
+
+// TooManyRequestsError returns a new StatusError with Status StatusTooManyRequests,
+// the time the client should wait before retrying, and optional Title and Message
+func TooManyRequestsError(e error, retryAfter time.Duration, args ...string) *StatusError {
+	err := Error(e, http.StatusTooManyRequests, "Too Many Requests", "Sorry, you've made too many requests, please try again later.")
+	err.RetryAfter = retryAfter
+	return err.setupFromArgs(args...)
+}
+
+// ServiceUnavailableError returns a new StatusError with Status StatusServiceUnavailable,
+// the time the client should wait before retrying (or 0), and optional Title and Message
+func ServiceUnavailableError(e error, retryAfter time.Duration, args ...string) *StatusError {
+	err := Error(e, http.StatusServiceUnavailable, "Service Unavailable", "Sorry, we're unavailable at the moment, please try again later.")
+	err.RetryAfter = retryAfter
+	return err.setupFromArgs(args...)
+}
+
 // Error returns a new StatusError with code StatusInternalServerError and a generic message
 func Error(e error, s int, t string, m string) *StatusError {
 	// Get runtime info - use zero values if none available
@@ -85,13 +185,124 @@ func Error(e error, s int, t string, m string) *StatusError {
 		File:    f,
 		Line:    l,
 	}
+	if CaptureStack {
+		pc := make([]uintptr, maxStackDepth)
+		// Skip runtime.Callers, Error and the constructor
+		n := runtime.Callers(3, pc)
+		err.Stack = pc[:n]
+	}
 	return err
 }
 
-// ToStatusError returns a *StatusError or wraps a standard error in a 500 StatusError
+// ToStatusError returns the *StatusError in the error chain, or wraps a standard error in a 500 StatusError
 func ToStatusError(e error) *StatusError {
-	if err, ok := e.(*StatusError); ok {
+	var err *StatusError
+	if errors.As(e, &err) {
 		return err
 	}
 	return Error(e, http.StatusInternalServerError, "Error", "Sorry, an error occurred.")
 }
+
+// statusError returns the *StatusError in the error chain, or wraps a standard error
+// in a 500 StatusError without caller info, as the caller would be in this package
+func statusError(e error) *StatusError {
+	var err *StatusError
+	if errors.As(e, &err) {
+		return err
+	}
+	return &StatusError{
+		Err:     e,
+		Status:  http.StatusInternalServerError,
+		Title:   "Error",
+		Message: "Sorry, an error occurred.",
+	}
+}
+
+// ValidationError is a StatusError with Status StatusUnprocessableEntity
+// which collects messages for invalid fields, for display in forms and
+// in the errors member of problem+json responses.
+// Usage:
+//
+//	v := server.NewValidationError()
+//	v.Add("email", "is required")
+//	v.Merge("address", validateAddress(address))
+//	return v.ErrorOrNil()
+type ValidationError struct {
+	*StatusError
+}
+
+// NewValidationError returns a new ValidationError without field errors and optional Title and Message
+func NewValidationError(args ...string) *ValidationError {
+	err := Error(errors.New("validation failed"), http.StatusUnprocessableEntity, "Invalid Data", "Sorry, some of your data is invalid, please check the fields shown.")
+	err.Fields = make(map[string][]string)
+	return &ValidationError{StatusError: err.setupFromArgs(args...)}
+}
+
+// Error returns the field errors as a string, sorted by field name
+func (v *ValidationError) Error() string {
+	fields := make([]string, 0, len(v.Fields))
+	for field := range v.Fields {
+		fields = append(fields, field)
+	}
+	sort.Strings(fields)
+	var messages []string
+	for _, field := range fields {
+		messages = append(messages, fmt.Sprintf("%s %s", field, strings.Join(v.Fields[field], ", ")))
+	}
+	return fmt.Sprintf("validation failed: %s", strings.Join(messages, "; "))
+}
+
+// Unwrap returns the StatusError, so that ToStatusError and errors.As find it
+func (v *ValidationError) Unwrap() error {
+	return v.StatusError
+}
+
+// Add adds a message for the field given
+func (v *ValidationError) Add(field, message string) *ValidationError {
+	if v.Fields == nil {
+		v.Fields = make(map[string][]string)
+	}
+	v.Fields[field] = append(v.Fields[field], message)
+	return v
+}
+
+// Merge adds the field errors from err, for example from validating
+// a nested struct, with field names prefixed by prefix and a dot if given.
+// Errors without field errors are added under the prefix.
+func (v *ValidationError) Merge(prefix string, err error) *ValidationError {
+	if err == nil {
+		return v
+	}
+	var e *StatusError
+	if !errors.As(err, &e) || len(e.Fields) == 0 {
+		v.Add(prefix, err.Error())
+		return v
+	}
+	for field, messages := range e.Fields {
+		if prefix != "" {
+			field = prefix + "." + field
+		}
+		for _, message := range messages {
+			v.Add(field, message)
+		}
+	}
+	return v
+}
+
+// Field returns the messages for the field given, for display in forms
+func (v *ValidationError) Field(field string) []string {
+	return v.Fields[field]
+}
+
+// HasErrors returns true if any field errors have been added
+func (v *ValidationError) HasErrors() bool {
+	return len(v.Fields) > 0
+}
+
+// ErrorOrNil returns the error if any field errors have been added, or nil
+func (v *ValidationError) ErrorOrNil() error {
+	if v.HasErrors() {
+		return v
+	}
+	return nil
+}
@@ -0,0 +1,302 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fragmenta/server/config"
+)
+
+// TestRenderError tests errors are rendered in the format the client accepts.
+func TestRenderError(t *testing.T) {
+	err := NotFoundError(errors.New("missing row"))
+
+	// Details are shown in development only
+	c := config.New()
+	c.Mode = config.ModeDevelopment
+	config.Current = c
+	defer func() { config.Current = nil }()
+
+	// Browsers get html
+	r := httptest.NewRequest("GET", "/pages/1", nil)
+	r.Header.Set("Accept", "text/html,application/xhtml+xml,application/xml;q=0.9,*/*;q=0.8")
+	w := httptest.NewRecorder()
+	RenderError(w, r, err)
+	if w.Code != http.StatusNotFound || !strings.HasPrefix(w.Header().Get("Content-Type"), "text/html") {
+		t.Fatalf("errors: wrong html response got:%d %s", w.Code, w.Header().Get("Content-Type"))
+	}
+	if !strings.Contains(w.Body.String(), "<h1>Not Found</h1>") || !strings.Contains(w.Body.String(), "missing row") {
+		t.Fatalf("errors: wrong html body got:%s", w.Body.String())
+	}
+
+	// Api clients get problem+json or json
+	for _, accept := range []string{"application/problem+json", "application/json"} {
+		r = httptest.NewRequest("GET", "/pages/1", nil)
+		r.Header.Set("Accept", accept)
+		w = httptest.NewRecorder()
+		RenderError(w, r, err)
+		if w.Header().Get("Content-Type") != accept {
+			t.Fatalf("errors: wrong content type expected:%s got:%s", accept, w.Header().Get("Content-Type"))
+		}
+		var p Problem
+		json.Unmarshal(w.Body.Bytes(), &p)
+		if p.Status != http.StatusNotFound || p.Instance != "/pages/1" || p.Error != "missing row" || p.File == "" {
+			t.Fatalf("errors: wrong problem got:%+v", p)
+		}
+	}
+
+	// Other errors are rendered as 500, without the location in this package
+	r = httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("Accept", "application/json")
+	w = httptest.NewRecorder()
+	RenderError(w, r, errors.New("secret failure"))
+	if w.Code != http.StatusInternalServerError || !strings.Contains(w.Body.String(), "secret") || strings.Contains(w.Body.String(), "file") {
+		t.Fatalf("errors: wrong details for standard error got:%s", w.Body.String())
+	}
+
+	// Details are hidden in production, or if no config is loaded
+	c.Mode = config.ModeProduction
+	for _, current := range []*config.Config{c, nil} {
+		config.Current = current
+		w = httptest.NewRecorder()
+		RenderError(w, r, errors.New("secret failure"))
+		if w.Code != http.StatusInternalServerError || strings.Contains(w.Body.String(), "secret") || strings.Contains(w.Body.String(), "file") {
+			t.Fatalf("errors: details shown in production got:%s", w.Body.String())
+		}
+	}
+}
+
+// TestHandlerFunc tests errors returned by handlers are rendered once.
+func TestHandlerFunc(t *testing.T) {
+	h := HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+		switch r.URL.Path {
+		case "/missing":
+			return NotFoundError(errors.New("missing row"))
+		case "/canceled":
+			return context.Canceled
+		case "/started":
+			w.Write([]byte("partial"))
+			return errors.New("failed writing")
+		case "/copied":
+			io.Copy(w, strings.NewReader("copied"))
+			return errors.New("failed copying")
+		}
+		w.Write([]byte("ok"))
+		return nil
+	})
+
+	tests := []struct {
+		path   string
+		status int
+		body   string
+	}{
+		{"/", http.StatusOK, "ok"},
+		{"/missing", http.StatusNotFound, "Not Found"},
+		{"/canceled", StatusClientClosedRequest, ""},
+		{"/started", http.StatusOK, "partial"},
+		{"/copied", http.StatusOK, "copied"},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest("GET", test.path, nil)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if w.Code != test.status || !strings.Contains(w.Body.String(), test.body) {
+			t.Fatalf("errors: wrong response for %s got:%d %s", test.path, w.Code, w.Body.String())
+		}
+		if (test.path == "/started" || test.path == "/copied") && w.Body.String() != test.body {
+			t.Fatalf("errors: error written after response started got:%s", w.Body.String())
+		}
+	}
+
+	// Hijacked connections are not written to
+	server := httptest.NewServer(HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+		conn, buf, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+		buf.WriteString("HTTP/1.1 200 OK\r\nContent-Length: 8\r\nConnection: close\r\n\r\nhijacked")
+		buf.Flush()
+		return errors.New("failed after hijack")
+	}))
+	defer server.Close()
+	resp, err := http.Get(server.URL)
+	if err != nil {
+		t.Fatalf("errors: error requesting hijacked handler %s", err)
+	}
+	b, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || string(b) != "hijacked" {
+		t.Fatalf("errors: wrong hijacked response got:%d %s", resp.StatusCode, b)
+	}
+
+	// A custom error handler may be used
+	var handled error
+	custom := NewHandler(h, func(w http.ResponseWriter, r *http.Request, err error) {
+		handled = err
+		w.WriteHeader(http.StatusTeapot)
+	})
+	w := httptest.NewRecorder()
+	custom.ServeHTTP(w, httptest.NewRequest("GET", "/missing", nil))
+	if w.Code != http.StatusTeapot || ToStatusError(handled).Status != http.StatusNotFound {
+		t.Fatalf("errors: custom error handler not used got:%d", w.Code)
+	}
+
+	// The custom error handler receives the error returned, so it can match wrapped types
+	custom = NewHandler(func(w http.ResponseWriter, r *http.Request) error {
+		return fmt.Errorf("saving user %w", NewValidationError().Add("email", "is required"))
+	}, func(w http.ResponseWriter, r *http.Request, err error) {
+		handled = err
+	})
+	custom.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("POST", "/users", nil))
+	var ve *ValidationError
+	if !errors.As(handled, &ve) || !strings.HasPrefix(handled.Error(), "saving user") {
+		t.Fatalf("errors: custom error handler not passed the error returned got:%v", handled)
+	}
+}
+
+// TestStatusError tests wrapping, matching and rendering of status errors.
+func TestStatusError(t *testing.T) {
+	err := fmt.Errorf("loading page %w", NotFoundError(sql.ErrNoRows))
+	if !errors.Is(err, sql.ErrNoRows) {
+		t.Fatalf("errors: wrapped error not matched")
+	}
+	if !errors.Is(err, &StatusError{Status: http.StatusNotFound}) || errors.Is(err, &StatusError{Status: http.StatusGone}) {
+		t.Fatalf("errors: status not matched")
+	}
+	if ToStatusError(err).Status != http.StatusNotFound {
+		t.Fatalf("errors: wrapped status error not found got:%d", ToStatusError(err).Status)
+	}
+
+	// Short paths must not panic
+	e := &StatusError{File: "main.go", Line: 3}
+	if e.FileLine() != "main.go:3" {
+		t.Fatalf("errors: wrong file line got:%s", e.FileLine())
+	}
+	e = &StatusError{File: "/a/b/c/d/e.go", Line: 3}
+	if e.FileLine() != "b/c/d/e.go:3" {
+		t.Fatalf("errors: wrong file line got:%s", e.FileLine())
+	}
+
+	// Retry-After and field errors are rendered
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("Accept", "application/problem+json")
+	w := httptest.NewRecorder()
+	RenderError(w, r, TooManyRequestsError(nil, 1500*time.Millisecond))
+	if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") != "2" {
+		t.Fatalf("errors: wrong retry after got:%d %s", w.Code, w.Header().Get("Retry-After"))
+	}
+	w = httptest.NewRecorder()
+	RenderError(w, r, UnprocessableEntityError(nil, map[string][]string{"email": {"is required"}}))
+	var p Problem
+	json.Unmarshal(w.Body.Bytes(), &p)
+	if w.Code != http.StatusUnprocessableEntity || p.Errors["email"][0] != "is required" {
+		t.Fatalf("errors: wrong field errors got:%s", w.Body.String())
+	}
+
+	// Stacks are captured if requested
+	CaptureStack = true
+	defer func() { CaptureStack = false }()
+	e = ForbiddenError(nil)
+	if e.Status != http.StatusForbidden || !strings.Contains(e.StackTrace(), "TestStatusError") {
+		t.Fatalf("errors: stack not captured got:%s", e.StackTrace())
+	}
+}
+
+// TestValidationError tests field errors are collected and rendered.
+func TestValidationError(t *testing.T) {
+	v := NewValidationError()
+	if v.ErrorOrNil() != nil {
+		t.Fatalf("errors: empty validation error not nil")
+	}
+
+	address := NewValidationError().Add("street", "is required")
+	v.Add("email", "is required").Add("email", "is invalid")
+	v.Merge("address", address)
+	v.Merge("", nil)
+
+	err := fmt.Errorf("saving user %w", v.ErrorOrNil())
+	var ve *ValidationError
+	if !errors.As(err, &ve) || len(ve.Field("email")) != 2 || ve.Field("address.street")[0] != "is required" {
+		t.Fatalf("errors: wrong field errors got:%v", v.Fields)
+	}
+	expected := "validation failed: address.street is required; email is required, is invalid"
+	if v.Error() != expected {
+		t.Fatalf("errors: wrong error expected:%s got:%s", expected, v.Error())
+	}
+
+	r := httptest.NewRequest("POST", "/users", nil)
+	r.Header.Set("Accept", "application/problem+json")
+	w := httptest.NewRecorder()
+	RenderError(w, r, err)
+	var p Problem
+	json.Unmarshal(w.Body.Bytes(), &p)
+	if w.Code != http.StatusUnprocessableEntity || len(p.Errors["email"]) != 2 || len(p.Errors["address.street"]) != 1 {
+		t.Fatalf("errors: wrong validation problem got:%s", w.Body.String())
+	}
+
+	r.Header.Set("Accept", "text/html")
+	w = httptest.NewRecorder()
+	RenderError(w, r, err)
+	if !strings.Contains(w.Body.String(), "<li>email: is invalid</li>") {
+		t.Fatalf("errors: field errors not in html got:%s", w.Body.String())
+	}
+}
+
+// TestRecover tests panics are recovered and rendered as internal errors.
+func TestRecover(t *testing.T) {
+	c := config.New()
+	c.Mode = config.ModeDevelopment
+	config.Current = c
+	defer func() { config.Current = nil }()
+
+	var recovered *StatusError
+	h := NewRecoverer(func(r *http.Request, err *StatusError) {
+		recovered = err
+	}).Middleware(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/started" {
+			w.Write([]byte("partial"))
+		}
+		panic(sql.ErrConnDone)
+	})
+
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("Accept", "application/json")
+	w := httptest.NewRecorder()
+	h(w, r)
+	if w.Code != http.StatusInternalServerError || !strings.Contains(w.Body.String(), "panic") {
+		t.Fatalf("errors: panic not rendered got:%d %s", w.Code, w.Body.String())
+	}
+	if recovered == nil || !errors.Is(recovered, sql.ErrConnDone) || !strings.HasSuffix(recovered.File, "errors_test.go") {
+		t.Fatalf("errors: hook not called with panic got:%v", recovered)
+	}
+	if !strings.Contains(recovered.StackTrace(), "TestRecover") {
+		t.Fatalf("errors: stack not captured got:%s", recovered.StackTrace())
+	}
+
+	// A panic after the response has started is not rendered
+	w = httptest.NewRecorder()
+	h(w, httptest.NewRequest("GET", "/started", nil))
+	if w.Code != http.StatusOK || w.Body.String() != "partial" {
+		t.Fatalf("errors: panic rendered after response started got:%s", w.Body.String())
+	}
+
+	// Aborted handlers are not recovered
+	defer func() {
+		if recover() != http.ErrAbortHandler {
+			t.Fatalf("errors: abort handler recovered")
+		}
+	}()
+	Recover(func(w http.ResponseWriter, r *http.Request) {
+		panic(http.ErrAbortHandler)
+	})(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+}
@@ -0,0 +1,213 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"hash"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DefaultETagMaxSize is the size above which responses are streamed without an etag.
+const DefaultETagMaxSize = 1 << 20
+
+// ETagger is a middleware which buffers responses to GET requests, hashes
+// the body to set an ETag, and answers requests with a matching
+// If-None-Match with 304 Not Modified.
+// Responses which set their own ETag, are not 200 OK, are larger than
+// MaxSize, are event streams or are flushed are streamed without an ETag.
+type ETagger struct {
+	// Hash returns the hash used for etags, sha256 by default,
+	// a faster non-cryptographic hash like xxhash may be used instead
+	Hash func() hash.Hash
+
+	// Weak sets weak etags, which should be used if responses are
+	// equivalent but not byte for byte identical
+	Weak bool
+
+	// MaxSize is the size above which responses are not buffered
+	MaxSize int
+}
+
+// NewETagger returns an ETagger using sha256 and strong etags.
+func NewETagger() *ETagger {
+	return &ETagger{
+		Hash:    sha256.New,
+		MaxSize: DefaultETagMaxSize,
+	}
+}
+
+// Middleware adds etags to responses and answers conditional requests.
+func (e *ETagger) Middleware(h http.HandlerFunc) http.HandlerFunc {
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			h(w, r)
+			return
+		}
+
+		ew := &etagWriter{
+			ResponseWriter: w,
+			etagger:        e,
+			status:         http.StatusOK,
+		}
+		h(ew, r)
+		ew.finish(r)
+	}
+
+}
+
+// etagWriter buffers a response until it is complete, unless the response
+// is too large or unsuitable for an etag, in which case it streams it.
+type etagWriter struct {
+	http.ResponseWriter
+	etagger *ETagger
+	buf     bytes.Buffer
+	status  int
+
+	// wroteHeader is set when the handler calls WriteHeader
+	wroteHeader bool
+
+	// streaming is set once the response is passed through unbuffered
+	streaming bool
+
+	// hijacked is set once the handler has taken over the connection
+	hijacked bool
+}
+
+// WriteHeader records the status, streaming responses other than 200 OK.
+func (ew *etagWriter) WriteHeader(status int) {
+	if ew.streaming || ew.wroteHeader {
+		ew.ResponseWriter.WriteHeader(status)
+		return
+	}
+	ew.wroteHeader = true
+	ew.status = status
+	if !ew.bufferable() {
+		ew.stream()
+	}
+}
+
+// Write buffers the body, or streams it if it grows too large.
+func (ew *etagWriter) Write(b []byte) (int, error) {
+	if !ew.wroteHeader {
+		ew.WriteHeader(http.StatusOK)
+	}
+	if ew.streaming {
+		return ew.ResponseWriter.Write(b)
+	}
+	if ew.buf.Len()+len(b) > ew.maxSize() {
+		err := ew.stream()
+		if err != nil {
+			return 0, err
+		}
+		return ew.ResponseWriter.Write(b)
+	}
+	return ew.buf.Write(b)
+}
+
+// Flush streams the response, as the handler wants it sent immediately.
+func (ew *etagWriter) Flush() {
+	if !ew.wroteHeader {
+		ew.WriteHeader(http.StatusOK)
+	}
+	if !ew.streaming {
+		ew.stream()
+	}
+	http.NewResponseController(ew.ResponseWriter).Flush()
+}
+
+// Hijack hijacks the underlying connection, for example for websockets,
+// nothing more is written to the response once it is hijacked.
+func (ew *etagWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn, rw, err := http.NewResponseController(ew.ResponseWriter).Hijack()
+	if err == nil {
+		ew.hijacked = true
+	}
+	return conn, rw, err
+}
+
+// Unwrap returns the underlying writer for http.ResponseController.
+func (ew *etagWriter) Unwrap() http.ResponseWriter {
+	return ew.ResponseWriter
+}
+
+// bufferable returns true if the response may be buffered for an etag.
+func (ew *etagWriter) bufferable() bool {
+	header := ew.Header()
+	return ew.status == http.StatusOK &&
+		header.Get("ETag") == "" &&
+		!strings.HasPrefix(header.Get("Content-Type"), "text/event-stream")
+}
+
+// stream writes the header and any buffered body, and passes
+// further writes through unbuffered.
+func (ew *etagWriter) stream() error {
+	ew.streaming = true
+	ew.ResponseWriter.WriteHeader(ew.status)
+	if ew.buf.Len() > 0 {
+		_, err := ew.ResponseWriter.Write(ew.buf.Bytes())
+		ew.buf.Reset()
+		return err
+	}
+	return nil
+}
+
+// finish sets the etag on a buffered response and writes it,
+// or writes 304 Not Modified if the etag matches the request.
+func (ew *etagWriter) finish(r *http.Request) {
+	if ew.streaming || ew.hijacked {
+		return
+	}
+	if !ew.bufferable() {
+		ew.stream()
+		return
+	}
+
+	hashFunc := ew.etagger.Hash
+	if hashFunc == nil {
+		hashFunc = sha256.New
+	}
+	hash := hashFunc()
+	hash.Write(ew.buf.Bytes())
+	etag := `"` + hex.EncodeToString(hash.Sum(nil)) + `"`
+	if ew.etagger.Weak {
+		etag = WeakETag(etag)
+	}
+
+	header := ew.Header()
+	header.Set("ETag", etag)
+
+	if NotModified(r, etag, ew.lastModified()) {
+		header.Del("Content-Type")
+		header.Del("Content-Length")
+		ew.ResponseWriter.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	header.Set("Content-Length", strconv.Itoa(ew.buf.Len()))
+	ew.ResponseWriter.WriteHeader(ew.status)
+	ew.ResponseWriter.Write(ew.buf.Bytes())
+}
+
+// lastModified returns the Last-Modified time set by the handler, if any.
+func (ew *etagWriter) lastModified() (t time.Time) {
+	lm := ew.Header().Get("Last-Modified")
+	if lm != "" {
+		t, _ = http.ParseTime(lm)
+	}
+	return t
+}
+
+// maxSize returns the size above which responses are streamed.
+func (ew *etagWriter) maxSize() int {
+	if ew.etagger.MaxSize > 0 {
+		return ew.etagger.MaxSize
+	}
+	return DefaultETagMaxSize
+}
@@ -2,7 +2,12 @@ module github.com/fragmenta/server
 
 go 1.25.0
 
-require golang.org/x/crypto v0.49.0
+require (
+	github.com/BurntSushi/toml v1.6.0
+	github.com/klauspost/compress v1.18.0
+	golang.org/x/crypto v0.49.0
+	gopkg.in/yaml.v3 v3.0.1
+)
 
 require (
 	golang.org/x/net v0.51.0 // indirect
@@ -0,0 +1,127 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+
+	"github.com/fragmenta/server/log"
+)
+
+// StatusClientClosedRequest is the non-standard status used when the
+// client closes the connection before the response is sent.
+const StatusClientClosedRequest = 499
+
+// HandlerFunc is a handler which returns an error, it is an http.Handler
+// which passes errors to DefaultErrorHandler.
+// Usage: mux.Handle("/pages/", server.HandlerFunc(handlePage))
+type HandlerFunc func(w http.ResponseWriter, r *http.Request) error
+
+// ErrorHandlerFunc handles an error returned by a HandlerFunc, err is the
+// error returned, use ToStatusError to find the status to render.
+type ErrorHandlerFunc func(w http.ResponseWriter, r *http.Request, err error)
+
+// DefaultErrorHandler is used to write errors returned by a HandlerFunc,
+// replace it to render errors with app templates.
+var DefaultErrorHandler ErrorHandlerFunc = RenderError
+
+// ServeHTTP calls the handler, and handles the error returned if any.
+func (h HandlerFunc) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	handleErrors(h, DefaultErrorHandler).ServeHTTP(w, r)
+}
+
+// NewHandler returns an http.Handler which calls h, and passes errors
+// to the errorHandler given instead of DefaultErrorHandler.
+func NewHandler(h HandlerFunc, errorHandler ErrorHandlerFunc) http.Handler {
+	return handleErrors(h, errorHandler)
+}
+
+// handleErrors returns a handler which calls h, logs any error returned, and
+// writes it with errorHandler unless the response has already been started.
+func handleErrors(h HandlerFunc, errorHandler ErrorHandlerFunc) http.HandlerFunc {
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		tw := &trackingWriter{ResponseWriter: w}
+		err := h(tw, r)
+		if err == nil {
+			return
+		}
+
+		// The client has gone away, so there is nobody to render an error for
+		if errors.Is(err, context.Canceled) {
+			log.Info(log.V{log.MessageKey: "server: request canceled", log.ErrorKey: err, log.URLKey: r.URL.Path, log.TraceKey: log.Trace(r)})
+			if !tw.wroteHeader {
+				tw.WriteHeader(StatusClientClosedRequest)
+			}
+			return
+		}
+
+		e := statusError(err)
+		log.Error(log.V{log.MessageKey: "server: error handling request", log.ErrorKey: err, "status": e.Status, log.URLKey: r.URL.Path, log.TraceKey: log.Trace(r)})
+
+		// Writing an error after the header would corrupt the response
+		if tw.wroteHeader {
+			return
+		}
+		if errorHandler == nil {
+			errorHandler = RenderError
+		}
+		errorHandler(tw, r, err)
+	}
+
+}
+
+// trackingWriter records whether the response has been started.
+type trackingWriter struct {
+	http.ResponseWriter
+	wroteHeader bool
+}
+
+// WriteHeader records that the header has been sent.
+func (tw *trackingWriter) WriteHeader(status int) {
+	// Informational responses may be followed by another header
+	if status >= 200 || status == http.StatusSwitchingProtocols {
+		tw.wroteHeader = true
+	}
+	tw.ResponseWriter.WriteHeader(status)
+}
+
+// Write records that the header has been sent.
+func (tw *trackingWriter) Write(b []byte) (int, error) {
+	tw.wroteHeader = true
+	return tw.ResponseWriter.Write(b)
+}
+
+// Flush records that the header has been sent and flushes the response.
+func (tw *trackingWriter) Flush() {
+	tw.wroteHeader = true
+	http.NewResponseController(tw.ResponseWriter).Flush()
+}
+
+// Hijack records that the connection has been taken over, so that
+// no error is written to it, and hijacks the underlying connection.
+func (tw *trackingWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn, rw, err := http.NewResponseController(tw.ResponseWriter).Hijack()
+	if err == nil {
+		tw.wroteHeader = true
+	}
+	return conn, rw, err
+}
+
+// ReadFrom records that the header has been sent and copies from src, using
+// the ReadFrom of the underlying writer if it has one (e.g. for sendfile).
+func (tw *trackingWriter) ReadFrom(src io.Reader) (int64, error) {
+	tw.wroteHeader = true
+	if rf, ok := tw.ResponseWriter.(io.ReaderFrom); ok {
+		return rf.ReadFrom(src)
+	}
+	return io.Copy(tw.ResponseWriter, src)
+}
+
+// Unwrap returns the underlying writer for http.ResponseController.
+func (tw *trackingWriter) Unwrap() http.ResponseWriter {
+	return tw.ResponseWriter
+}
@@ -3,6 +3,7 @@ package server
 import (
 	"fmt"
 	"net/http"
+	"strings"
 	"time"
 )
 
@@ -12,17 +13,220 @@ import (
 const daysToSeconds = 86400
 
 // Date format is the preferred date format for the Expires header
-const dateFormat = "Mon, 2 Jan 2006 15:04:05 MST"
+const dateFormat = http.TimeFormat
 
 // AddCacheHeaders adds Cache-Control, Expires and Etag headers
 // using the age in days and content hash provided
+// Use AddCachePolicy to set other directives and answer conditional requests.
 func AddCacheHeaders(w http.ResponseWriter, days int, hash string) {
 	// Cache for the given age in days
-	w.Header().Set("Cache-Control", fmt.Sprintf("max-age:%d", days*daysToSeconds))
+	w.Header().Set("Cache-Control", fmt.Sprintf("max-age=%d", days*daysToSeconds))
 
-	// Set an expires header of form Mon Jan 2 15:04:05 -0700 MST 2006
+	// Set an expires header of form Mon, 02 Jan 2006 15:04:05 GMT
 	w.Header().Set("Expires", time.Now().AddDate(0, 0, days).UTC().Format(dateFormat))
 
 	// For etag send the hash given
 	w.Header().Set("ETag", fmt.Sprintf("\"%s\"", hash))
 }
+
+// CachePolicy describes how a response may be cached,
+// use AddCachePolicy to set the headers for a response.
+type CachePolicy struct {
+	// Public allows shared caches (e.g. CDNs) to store the response
+	Public bool
+
+	// Private allows only the browser to store the response
+	Private bool
+
+	// NoCache requires caches to revalidate the response before use
+	NoCache bool
+
+	// NoStore prevents caches from storing the response at all
+	NoStore bool
+
+	// MaxAge is the time the response is fresh for
+	MaxAge time.Duration
+
+	// SharedMaxAge is the time the response is fresh for in shared caches
+	SharedMaxAge time.Duration
+
+	// Immutable indicates the response will not change while fresh,
+	// it is ignored unless MaxAge is set
+	Immutable bool
+
+	// StaleWhileRevalidate allows a stale response to be used while revalidating
+	StaleWhileRevalidate time.Duration
+
+	// ETag is the entity tag for the response, usually a content hash
+	ETag string
+
+	// WeakETag marks the ETag as weak, e.g. for compressed responses
+	WeakETag bool
+
+	// LastModified is the time the content was last modified
+	LastModified time.Time
+}
+
+// CacheControl returns the Cache-Control header value for this policy.
+func (p CachePolicy) CacheControl() string {
+	if p.NoStore {
+		return "no-store"
+	}
+
+	var directives []string
+	if p.Public {
+		directives = append(directives, "public")
+	} else if p.Private {
+		directives = append(directives, "private")
+	}
+	if p.NoCache {
+		directives = append(directives, "no-cache")
+	}
+	if p.MaxAge > 0 {
+		directives = append(directives, fmt.Sprintf("max-age=%d", int64(p.MaxAge.Seconds())))
+	}
+	if p.SharedMaxAge > 0 {
+		directives = append(directives, fmt.Sprintf("s-maxage=%d", int64(p.SharedMaxAge.Seconds())))
+	}
+	if p.StaleWhileRevalidate > 0 {
+		directives = append(directives, fmt.Sprintf("stale-while-revalidate=%d", int64(p.StaleWhileRevalidate.Seconds())))
+	}
+	if p.Immutable && p.MaxAge > 0 {
+		directives = append(directives, "immutable")
+	}
+	return strings.Join(directives, ", ")
+}
+
+// etag returns the quoted (and possibly weak) etag for this policy.
+func (p CachePolicy) etag() string {
+	if p.ETag == "" {
+		return ""
+	}
+	etag := p.ETag
+	if !strings.HasPrefix(etag, "\"") && !strings.HasPrefix(etag, "W/\"") {
+		etag = fmt.Sprintf("\"%s\"", etag)
+	}
+	if p.WeakETag {
+		etag = WeakETag(etag)
+	}
+	return etag
+}
+
+// AddCachePolicy sets the Cache-Control, ETag and Last-Modified headers
+// for the policy given. If the request is conditional and the content has not
+// been modified, it writes a 304 Not Modified response and returns true,
+// in which case the caller should not write a body.
+func AddCachePolicy(w http.ResponseWriter, r *http.Request, p CachePolicy) bool {
+	header := w.Header()
+
+	cc := p.CacheControl()
+	if cc != "" {
+		header.Set("Cache-Control", cc)
+	}
+
+	etag := p.etag()
+	if etag != "" {
+		header.Set("ETag", etag)
+	}
+
+	if !p.LastModified.IsZero() {
+		header.Set("Last-Modified", p.LastModified.UTC().Format(http.TimeFormat))
+	}
+
+	if NotModified(r, etag, p.LastModified) {
+		// Remove headers which do not apply to a 304 response
+		header.Del("Content-Type")
+		header.Del("Content-Length")
+		w.WriteHeader(http.StatusNotModified)
+		return true
+	}
+	return false
+}
+
+// NotModified returns true if the GET or HEAD request is conditional and
+// the etag or last modified time given match, so that a 304 response may be
+// sent instead of the content. If-None-Match takes precedence over
+// If-Modified-Since, as described in RFC 9110.
+func NotModified(r *http.Request, etag string, lastModified time.Time) bool {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return false
+	}
+
+	inm := r.Header.Get("If-None-Match")
+	if inm != "" {
+		return etag != "" && ETagMatch(inm, etag, false)
+	}
+
+	ims := r.Header.Get("If-Modified-Since")
+	if ims != "" && !lastModified.IsZero() {
+		t, err := http.ParseTime(ims)
+		if err != nil {
+			return false
+		}
+		// Compare to the second, as the header has no finer precision
+		return !lastModified.Truncate(time.Second).After(t)
+	}
+
+	return false
+}
+
+// ETagMatch returns true if etag matches one of the etags in the header
+// (an If-None-Match or If-Match list, or *). If strong is true, weak etags
+// never match, otherwise the weak comparison is used.
+func ETagMatch(header string, etag string, strong bool) bool {
+	header = strings.TrimSpace(header)
+	if header == "*" {
+		return true
+	}
+	if strong && strings.HasPrefix(etag, "W/") {
+		return false
+	}
+	for _, candidate := range parseETags(header) {
+		if strong && strings.HasPrefix(candidate, "W/") {
+			continue
+		}
+		if strings.TrimPrefix(candidate, "W/") == strings.TrimPrefix(etag, "W/") {
+			return true
+		}
+	}
+	return false
+}
+
+// WeakETag returns the weak form of an etag, e.g. W/"abc" for "abc".
+func WeakETag(etag string) string {
+	if etag == "" || strings.HasPrefix(etag, "W/") {
+		return etag
+	}
+	return "W/" + etag
+}
+
+// parseETags splits a list of etags, which may contain commas within quotes.
+func parseETags(header string) []string {
+	var etags []string
+	for {
+		header = strings.TrimLeft(header, " \t,")
+		if header == "" {
+			return etags
+		}
+		start := 0
+		if strings.HasPrefix(header, "W/") {
+			start = 2
+		}
+		if len(header) <= start || header[start] != '"' {
+			// Invalid etag, skip to the next comma
+			i := strings.IndexByte(header, ',')
+			if i < 0 {
+				return etags
+			}
+			header = header[i:]
+			continue
+		}
+		end := strings.IndexByte(header[start+1:], '"')
+		if end < 0 {
+			return etags
+		}
+		end += start + 2
+		etags = append(etags, header[:end])
+		header = header[end:]
+	}
+}
@@ -0,0 +1,247 @@
+package server
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	stdlog "log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// TestCachePolicy tests cache control directives and conditional requests.
+func TestCachePolicy(t *testing.T) {
+	p := CachePolicy{
+		Public:               true,
+		MaxAge:               time.Hour,
+		StaleWhileRevalidate: time.Minute,
+		Immutable:            true,
+		ETag:                 "abc",
+	}
+	expected := "public, max-age=3600, stale-while-revalidate=60, immutable"
+	if got := p.CacheControl(); got != expected {
+		t.Fatalf("headers: wrong cache control expected:%s got:%s", expected, got)
+	}
+	if got := (CachePolicy{NoStore: true, Public: true}).CacheControl(); got != "no-store" {
+		t.Fatalf("headers: wrong no-store cache control got:%s", got)
+	}
+	if got := (CachePolicy{Public: true, NoCache: true, Immutable: true}).CacheControl(); got != "public, no-cache" {
+		t.Fatalf("headers: immutable without max age got:%s", got)
+	}
+
+	// A request without conditions gets the full response
+	r := httptest.NewRequest("GET", "/", nil)
+	w := httptest.NewRecorder()
+	if AddCachePolicy(w, r, p) {
+		t.Fatalf("headers: unconditional request not modified")
+	}
+	if w.Header().Get("ETag") != `"abc"` {
+		t.Fatalf("headers: wrong etag got:%s", w.Header().Get("ETag"))
+	}
+
+	// A matching etag, including a weak one, gets a 304
+	r.Header.Set("If-None-Match", `"xyz", W/"abc"`)
+	w = httptest.NewRecorder()
+	if !AddCachePolicy(w, r, p) || w.Code != http.StatusNotModified {
+		t.Fatalf("headers: matching etag not answered with 304 got:%d", w.Code)
+	}
+
+	// If-Modified-Since is used when there is no If-None-Match
+	modified := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	r = httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("If-Modified-Since", modified.Format(http.TimeFormat))
+	if !NotModified(r, "", modified) {
+		t.Fatalf("headers: unmodified content not detected")
+	}
+	if NotModified(r, "", modified.Add(time.Hour)) {
+		t.Fatalf("headers: modified content not detected")
+	}
+
+	if ETagMatch(`W/"abc"`, `"abc"`, true) || !ETagMatch(`W/"abc"`, `"abc"`, false) {
+		t.Fatalf("headers: wrong strong/weak etag comparison")
+	}
+	if !ETagMatch(`"a,b", "c"`, `"a,b"`, true) || !ETagMatch("*", `"c"`, true) {
+		t.Fatalf("headers: etag list not parsed")
+	}
+}
+
+// TestETagger tests etags are set on buffered responses and skipped for streams.
+func TestETagger(t *testing.T) {
+	testHijack(t, NewETagger().Middleware)
+
+	e := NewETagger()
+	e.MaxSize = 16
+	h := e.Middleware(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/large":
+			w.Write([]byte("a response larger than the maximum size"))
+		case "/events":
+			w.Header().Set("Content-Type", "text/event-stream")
+			w.Write([]byte("data: 1\n\n"))
+		case "/flush":
+			w.Write([]byte("hello"))
+			w.(http.Flusher).Flush()
+		default:
+			w.Write([]byte("hello"))
+		}
+	})
+
+	r := httptest.NewRequest("GET", "/", nil)
+	w := httptest.NewRecorder()
+	h(w, r)
+	etag := w.Header().Get("ETag")
+	if etag == "" || w.Body.String() != "hello" || w.Header().Get("Content-Length") != "5" {
+		t.Fatalf("headers: etag not set etag:%s body:%s", etag, w.Body.String())
+	}
+
+	// A matching If-None-Match gets a 304 without a body
+	r = httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("If-None-Match", etag)
+	w = httptest.NewRecorder()
+	h(w, r)
+	if w.Code != http.StatusNotModified || w.Body.Len() != 0 {
+		t.Fatalf("headers: etag match wrong status got:%d", w.Code)
+	}
+
+	// Large, streamed and flushed responses are sent without an etag
+	for _, path := range []string{"/large", "/events", "/flush"} {
+		r = httptest.NewRequest("GET", path, nil)
+		w = httptest.NewRecorder()
+		h(w, r)
+		if w.Header().Get("ETag") != "" || w.Code != http.StatusOK || w.Body.Len() == 0 {
+			t.Fatalf("headers: etag set for %s got:%s", path, w.Header().Get("ETag"))
+		}
+	}
+
+	// Weak etags are matched by weak comparison
+	e.Weak = true
+	r = httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("If-None-Match", etag)
+	w = httptest.NewRecorder()
+	h(w, r)
+	if w.Code != http.StatusNotModified || w.Header().Get("ETag") != WeakETag(etag) {
+		t.Fatalf("headers: weak etag wrong got:%s", w.Header().Get("ETag"))
+	}
+}
+
+// testHijack tests the middleware allows a handler to hijack the connection,
+// and writes nothing to the connection once it is hijacked.
+func testHijack(t *testing.T, middleware func(http.HandlerFunc) http.HandlerFunc) {
+	h := middleware(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		conn, buf, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			t.Errorf("headers: error hijacking %s", err)
+			return
+		}
+		defer conn.Close()
+		buf.WriteString("HTTP/1.1 200 OK\r\nContent-Length: 8\r\nConnection: close\r\n\r\nhijacked")
+		buf.Flush()
+	})
+
+	done := make(chan struct{})
+	var errorLog bytes.Buffer
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer close(done)
+		h(w, r)
+	}))
+	server.Config.ErrorLog = stdlog.New(&errorLog, "", 0)
+	server.Start()
+	defer server.Close()
+
+	r, _ := http.NewRequest("GET", server.URL, nil)
+	r.Header.Set("Accept-Encoding", "gzip")
+	resp, err := http.DefaultTransport.RoundTrip(r)
+	if err != nil {
+		t.Fatalf("headers: error requesting hijacked handler %s", err)
+	}
+	b, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	<-done
+	if string(b) != "hijacked" || errorLog.Len() > 0 {
+		t.Fatalf("headers: wrong hijacked response got:%s log:%s", b, errorLog.String())
+	}
+}
+
+// TestCompressor tests responses are compressed with the negotiated encoding.
+func TestCompressor(t *testing.T) {
+	testHijack(t, NewCompressor().Middleware)
+
+	body := bytes.Repeat([]byte("<p>hello world</p>"), 100)
+	h := NewCompressor().Middleware(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/small":
+			w.Write([]byte("<p>hello</p>"))
+		case "/png":
+			w.Header().Set("Content-Type", "image/png")
+			w.Write(body)
+		default:
+			w.Header().Set("ETag", `"abc"`)
+			w.Write(body)
+		}
+	})
+
+	// Gzip is used if zstd is not accepted, and the etag weakened
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("Accept-Encoding", "gzip, deflate;q=0.5, zstd;q=0")
+	w := httptest.NewRecorder()
+	h(w, r)
+	if w.Header().Get("Content-Encoding") != "gzip" || w.Header().Get("Vary") != "Accept-Encoding" {
+		t.Fatalf("headers: gzip not used got:%s", w.Header().Get("Content-Encoding"))
+	}
+	if w.Header().Get("ETag") != `W/"abc"` {
+		t.Fatalf("headers: etag not weakened got:%s", w.Header().Get("ETag"))
+	}
+	if !strings.HasPrefix(w.Header().Get("Content-Type"), "text/html") {
+		t.Fatalf("headers: wrong content type got:%s", w.Header().Get("Content-Type"))
+	}
+	gz, err := gzip.NewReader(w.Body)
+	if err != nil {
+		t.Fatalf("headers: error reading gzip %s", err)
+	}
+	got, _ := io.ReadAll(gz)
+	if !bytes.Equal(got, body) {
+		t.Fatalf("headers: gzip body does not match got:%d bytes", len(got))
+	}
+
+	// Zstd is preferred, with pooled writers reused for later requests
+	for range 2 {
+		r = httptest.NewRequest("GET", "/", nil)
+		r.Header.Set("Accept-Encoding", "gzip, zstd")
+		w = httptest.NewRecorder()
+		h(w, r)
+		if w.Header().Get("Content-Encoding") != "zstd" {
+			t.Fatalf("headers: zstd not used got:%s", w.Header().Get("Content-Encoding"))
+		}
+		zr, err := zstd.NewReader(w.Body)
+		if err != nil {
+			t.Fatalf("headers: error reading zstd %s", err)
+		}
+		got, _ = io.ReadAll(zr)
+		zr.Close()
+		if !bytes.Equal(got, body) {
+			t.Fatalf("headers: zstd body does not match got:%d bytes", len(got))
+		}
+	}
+
+	// Small responses, other types and clients without compression are not compressed
+	for _, test := range []struct{ path, accept string }{
+		{"/small", "gzip"},
+		{"/png", "gzip"},
+		{"/", ""},
+		{"/", "br"},
+	} {
+		r = httptest.NewRequest("GET", test.path, nil)
+		r.Header.Set("Accept-Encoding", test.accept)
+		w = httptest.NewRecorder()
+		h(w, r)
+		if w.Header().Get("Content-Encoding") != "" || w.Body.Len() == 0 {
+			t.Fatalf("headers: compressed %s for %s got:%s", test.path, test.accept, w.Header().Get("Content-Encoding"))
+		}
+	}
+}
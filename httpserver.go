@@ -0,0 +1,170 @@
+package server
+
+import (
+	"crypto/tls"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/fragmenta/server/log"
+)
+
+// Config keys read by the server for timeouts and limits, durations may be
+// given as a Go duration (e.g. 5m) or as a number of seconds,
+// a duration of 0 or none disables the timeout.
+const (
+	ConfigReadHeaderTimeout = "server_read_header_timeout"
+	ConfigReadTimeout       = "server_read_timeout"
+	ConfigWriteTimeout      = "server_write_timeout"
+	ConfigIdleTimeout       = "server_idle_timeout"
+	ConfigMaxHeaderBytes    = "server_max_header_bytes"
+	ConfigMaxBodyBytes      = "server_max_body_bytes"
+	ConfigKeepAlives        = "server_keep_alives"
+)
+
+// Timeouts sets the timeouts used by the http servers started by Server.
+// Zero values are read from config or set from DefaultTimeouts,
+// negative values disable the timeout.
+type Timeouts struct {
+	ReadHeader time.Duration
+	Read       time.Duration
+	Write      time.Duration
+	Idle       time.Duration
+}
+
+// DefaultTimeouts are used if no timeouts are set, the default server
+// from net/http has no timeouts, so we set some limits.
+var DefaultTimeouts = Timeouts{
+	ReadHeader: 30 * time.Second,
+	Read:       60 * time.Second,
+	Write:      60 * time.Second,
+	Idle:       10 * time.Second,
+}
+
+// Limits sets limits on requests for the http servers started by Server.
+// Zero values are read from config, or use the net/http defaults.
+type Limits struct {
+	// MaxHeaderBytes limits the size of request headers
+	MaxHeaderBytes int
+
+	// MaxBodyBytes limits the size of request bodies, if 0 there is no limit
+	MaxBodyBytes int64
+
+	// DisableKeepAlives closes connections after each request
+	DisableKeepAlives bool
+}
+
+// httpServer returns an http server for addr with the timeouts and limits
+// set in options or config, all the Start methods use this as a template.
+func (s *Server) httpServer(addr string, handler http.Handler, tlsConfig *tls.Config) *http.Server {
+	timeouts := s.serverTimeouts()
+	limits := s.serverLimits()
+
+	if handler == nil {
+		handler = http.DefaultServeMux
+	}
+	if limits.MaxBodyBytes > 0 {
+		handler = http.MaxBytesHandler(handler, limits.MaxBodyBytes)
+	}
+
+	server := &http.Server{
+		// Set the address in the preferred string format
+		Addr:    addr,
+		Handler: handler,
+
+		// The default server from net/http has no timeouts - set some limits
+		ReadHeaderTimeout: timeouts.ReadHeader,
+		ReadTimeout:       timeouts.Read,
+		WriteTimeout:      timeouts.Write,
+		IdleTimeout:       timeouts.Idle,
+
+		MaxHeaderBytes: limits.MaxHeaderBytes,
+		TLSConfig:      tlsConfig,
+	}
+
+	if limits.DisableKeepAlives {
+		server.SetKeepAlivesEnabled(false)
+	}
+
+	return server
+}
+
+// serverTimeouts returns the timeouts set in options, then config,
+// then DefaultTimeouts. Disabled timeouts are returned as -1, since
+// net/http uses ReadTimeout for a ReadHeader or Idle timeout of 0.
+func (s *Server) serverTimeouts() Timeouts {
+	t := s.timeouts
+	t.ReadHeader = s.timeout(t.ReadHeader, ConfigReadHeaderTimeout, DefaultTimeouts.ReadHeader)
+	t.Read = s.timeout(t.Read, ConfigReadTimeout, DefaultTimeouts.Read)
+	t.Write = s.timeout(t.Write, ConfigWriteTimeout, DefaultTimeouts.Write)
+	t.Idle = s.timeout(t.Idle, ConfigIdleTimeout, DefaultTimeouts.Idle)
+	return t
+}
+
+// timeout returns the option value d if set, or the config value for key,
+// or the default value given.
+func (s *Server) timeout(d time.Duration, key string, defaultValue time.Duration) time.Duration {
+	if d == 0 {
+		d = s.configDuration(key)
+	}
+	if d == 0 {
+		d = defaultValue
+	}
+	if d < 0 {
+		return -1
+	}
+	return d
+}
+
+// serverLimits returns the limits set in options, or in config.
+func (s *Server) serverLimits() Limits {
+	l := s.limits
+	if l.MaxHeaderBytes == 0 {
+		l.MaxHeaderBytes = int(s.configInt(ConfigMaxHeaderBytes))
+	}
+	if l.MaxBodyBytes == 0 {
+		l.MaxBodyBytes = s.configInt(ConfigMaxBodyBytes)
+	}
+	if !l.DisableKeepAlives {
+		l.DisableKeepAlives = (s.Config(ConfigKeepAlives) == "no")
+	}
+	return l
+}
+
+// configDuration reads a duration from config, returning 0 if not set,
+// or -1 if set to 0 or none to disable the timeout.
+func (s *Server) configDuration(key string) time.Duration {
+	v := s.Config(key)
+	switch v {
+	case "":
+		return 0
+	case "0", "none":
+		return -1
+	}
+
+	// Accept a number of seconds or a duration string
+	seconds, err := strconv.Atoi(v)
+	if err == nil {
+		return time.Duration(seconds) * time.Second
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		log.Error(log.V{log.MessageKey: "server: invalid duration in config", "key": key, log.ErrorKey: err})
+		return 0
+	}
+	return d
+}
+
+// configInt reads an int from config, logging an error if it is invalid.
+func (s *Server) configInt(key string) int64 {
+	v := s.Config(key)
+	if v == "" {
+		return 0
+	}
+	i, err := strconv.ParseInt(v, 10, 64)
+	if err != nil {
+		log.Error(log.V{log.MessageKey: "server: invalid integer in config", "key": key, log.ErrorKey: err})
+		return 0
+	}
+	return i
+}
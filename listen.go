@@ -0,0 +1,218 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// ConfigListen is the config key for the address spec the server listens on,
+// see Listen for the formats accepted.
+const ConfigListen = "server_listen"
+
+// listenFdsStart is the first file descriptor passed by systemd socket activation.
+const listenFdsStart = 3
+
+// Listen returns a listener for the address spec given, which may be:
+//
+//	unix:/run/app.sock  - a unix socket at the path given
+//	fd:3                - a file descriptor inherited from the parent process
+//	systemd             - the first socket passed by systemd socket activation
+//	systemd:name        - the socket passed by systemd with FileDescriptorName=name
+//	tcp:127.0.0.1:3000  - a tcp address
+//	127.0.0.1:3000      - a tcp address
+func Listen(spec string) (net.Listener, error) {
+	network, address, _ := strings.Cut(spec, ":")
+	switch network {
+	case "unix":
+		return listenUnix(address)
+	case "fd":
+		fd, err := strconv.Atoi(address)
+		if err != nil {
+			return nil, fmt.Errorf("server: invalid fd in listen spec %s", spec)
+		}
+		return listenFd(uintptr(fd), spec)
+	case "systemd":
+		return listenSystemd(address)
+	case "tcp", "tcp4", "tcp6":
+		return net.Listen(network, address)
+	}
+
+	// Otherwise treat the whole spec as a tcp address
+	return net.Listen("tcp", spec)
+}
+
+// listenUnix listens on a unix socket at path, removing a stale socket left
+// behind by a previous process if there is one.
+func listenUnix(path string) (net.Listener, error) {
+	if path == "" {
+		return nil, errors.New("server: empty unix socket path")
+	}
+	info, err := os.Stat(path)
+	if err == nil && info.Mode()&os.ModeSocket != 0 {
+		os.Remove(path)
+	}
+	return net.Listen("unix", path)
+}
+
+// listenFd returns a listener for an inherited file descriptor.
+func listenFd(fd uintptr, name string) (net.Listener, error) {
+	f := os.NewFile(fd, name)
+	if f == nil {
+		return nil, fmt.Errorf("server: invalid fd %d", fd)
+	}
+	// FileListener dups the fd, so we close our copy
+	defer f.Close()
+	l, err := net.FileListener(f)
+	if err != nil {
+		return nil, fmt.Errorf("server: error listening on fd %d %v", fd, err)
+	}
+	return l, nil
+}
+
+// listenSystemd returns a listener for a socket passed by systemd socket
+// activation, selected by name if given, or the first socket if not.
+func listenSystemd(name string) (net.Listener, error) {
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return nil, errors.New("server: no sockets passed by systemd for this process")
+	}
+	count, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || count < 1 {
+		return nil, errors.New("server: no sockets passed by systemd for this process")
+	}
+
+	index := 0
+	if name != "" {
+		index = -1
+		names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+		for i, n := range names {
+			if n == name && i < count {
+				index = i
+				break
+			}
+		}
+		if index < 0 {
+			return nil, fmt.Errorf("server: no socket named %s passed by systemd", name)
+		}
+	}
+
+	return listenFd(uintptr(listenFdsStart+index), "systemd:"+name)
+}
+
+// Names of the listeners opened by the Start methods, used to hand
+// listeners over to a new process on Upgrade.
+const (
+	listenerMain     = "main"
+	listenerACME     = "acme"
+	listenerRedirect = "redirect"
+)
+
+// mainListeners returns the listeners for the main server, set with
+// WithListener, or from the listen spec in options or config, or by
+// listening on Addresses.
+func (s *Server) mainListeners() ([]net.Listener, error) {
+	if s.listener != nil {
+		s.registerListener(listenerMain, s.listener)
+		return []net.Listener{s.listener}, nil
+	}
+	spec := s.listen
+	if spec == "" {
+		spec = s.Config(ConfigListen)
+	}
+	if spec != "" {
+		l, err := s.listenNamed(listenerMain, spec)
+		if err != nil {
+			return nil, err
+		}
+		return []net.Listener{l}, nil
+	}
+	return s.listenAll(listenerMain, s.Addresses())
+}
+
+// listenAll returns listeners for all the addresses given, named by
+// name@address. If any address fails, the other listeners are closed.
+func (s *Server) listenAll(name string, addresses []string) ([]net.Listener, error) {
+	var listeners []net.Listener
+	for _, addr := range addresses {
+		l, err := s.listenNamed(name+"@"+addr, addr)
+		if err != nil {
+			s.closeListeners(listeners)
+			return nil, err
+		}
+		listeners = append(listeners, l)
+	}
+	return listeners, nil
+}
+
+// serveAll serves on all the listeners given using one http server,
+// returning the first error. If one listener fails, the server is closed.
+func serveAll(server *http.Server, listeners []net.Listener, useTLS bool) error {
+	errs := make(chan error, len(listeners))
+	for _, l := range listeners {
+		go func() {
+			if useTLS {
+				errs <- server.ServeTLS(l, "", "")
+			} else {
+				errs <- server.Serve(l)
+			}
+		}()
+	}
+	err := <-errs
+	if !errors.Is(err, http.ErrServerClosed) {
+		server.Close()
+	}
+	return err
+}
+
+// listenNamed returns a listener for spec, or the listener with the same
+// name inherited from a parent process on upgrade. Listeners are registered
+// by name so that they can be handed over to a new process in turn.
+func (s *Server) listenNamed(name, spec string) (net.Listener, error) {
+	l, err := inheritedListener(name)
+	if err != nil {
+		return nil, err
+	}
+	if l == nil {
+		l, err = Listen(spec)
+		if err != nil {
+			return nil, err
+		}
+	}
+	s.registerListener(name, l)
+	return l, nil
+}
+
+// closeListeners unregisters and closes the listeners given,
+// unix sockets opened by this process are removed on close.
+func (s *Server) closeListeners(listeners []net.Listener) {
+	for _, l := range listeners {
+		s.unregisterListener(l)
+		l.Close()
+	}
+}
+
+// unregisterListener removes the listener from our named listeners.
+func (s *Server) unregisterListener(l net.Listener) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for name, v := range s.listeners {
+		if v == l {
+			delete(s.listeners, name)
+		}
+	}
+}
+
+// registerListener records the listener under name.
+func (s *Server) registerListener(name string, l net.Listener) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.listeners == nil {
+		s.listeners = make(map[string]net.Listener)
+	}
+	s.listeners[name] = l
+}
@@ -0,0 +1,242 @@
+package server
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+
+	"github.com/fragmenta/server/config"
+)
+
+// DefaultPort is the port used if none is set in options or config.
+const DefaultPort = 3000
+
+// Option configures a Server created with NewWithOptions.
+type Option func(*Server)
+
+// WithPort sets the port to serve on, this takes precedence over
+// the port key in config.
+func WithPort(port int) Option {
+	return func(s *Server) {
+		s.port = port
+	}
+}
+
+// WithAddress sets the host address to bind to, for example 127.0.0.1,
+// by default the server listens on all interfaces.
+func WithAddress(host string) Option {
+	return func(s *Server) {
+		s.bind = []bindAddress{{host: host}}
+	}
+}
+
+// WithBind sets several addresses to bind to, each may be a host
+// (e.g. 127.0.0.1 or ::1) which uses the server port, or a host:port pair.
+// This takes precedence over the bind key in config.
+func WithBind(addresses ...string) Option {
+	return func(s *Server) {
+		s.bind = parseBind(strings.Join(addresses, " "))
+	}
+}
+
+// WithListener sets the listener used by the Start methods, for example
+// a listener passed in by a supervisor. Port and address are ignored.
+func WithListener(l net.Listener) Option {
+	return func(s *Server) {
+		s.listener = l
+	}
+}
+
+// WithListen sets an address spec for the Start methods to listen on,
+// for example unix:/run/app.sock, fd:3, systemd or tcp:127.0.0.1:3000.
+// See Listen for details of the formats accepted.
+func WithListen(spec string) Option {
+	return func(s *Server) {
+		s.listen = spec
+	}
+}
+
+// WithMode sets the mode of the server, using the mode constants
+// from server/config (e.g. config.ModeProduction). This takes precedence
+// over the mode of the config, and selects the values used from it.
+func WithMode(mode int) Option {
+	return func(s *Server) {
+		s.mode = &mode
+	}
+}
+
+// WithConfig sets the config used by the server. The port key is used
+// if no port is set with WithPort, and the mode is taken from the config
+// unless set with WithMode.
+func WithConfig(c *config.Config) Option {
+	return func(s *Server) {
+		s.config = c
+	}
+}
+
+// WithTimeouts sets the timeouts for the http servers started,
+// these take precedence over the timeout keys in config.
+func WithTimeouts(t Timeouts) Option {
+	return func(s *Server) {
+		s.timeouts = t
+	}
+}
+
+// WithLimits sets the request limits for the http servers started,
+// these take precedence over the limit keys in config.
+func WithLimits(l Limits) Option {
+	return func(s *Server) {
+		s.limits = l
+	}
+}
+
+// WithCertReloadInterval sets the interval at which cert and key files
+// passed to StartTLS are checked for changes, a negative value disables reloading.
+func WithCertReloadInterval(d time.Duration) Option {
+	return func(s *Server) {
+		s.certReloadInterval = d
+	}
+}
+
+// WithClientAuth sets the CA bundle used to verify client certs and the
+// client auth mode for all the TLS start methods, for example
+// tls.RequireAndVerifyClientCert for service to service traffic.
+func WithClientAuth(caFile string, auth tls.ClientAuthType) Option {
+	return func(s *Server) {
+		s.clientCA = caFile
+		s.clientAuth = auth
+	}
+}
+
+// WithACMEDirectory sets the URL of the ACME directory used by autocert,
+// for example a Let's Encrypt staging directory or a local Pebble server.
+func WithACMEDirectory(url string) Option {
+	return func(s *Server) {
+		s.acmeDirectory = url
+	}
+}
+
+// WithACMEClient sets the ACME client used by autocert, this takes
+// precedence over WithACMEDirectory, and allows a custom http client.
+func WithACMEClient(c *acme.Client) Option {
+	return func(s *Server) {
+		s.acmeClient = c
+	}
+}
+
+// WithACMEExternalAccount sets the external account binding (EAB) key id
+// and HMAC key for ACME providers which require one.
+func WithACMEExternalAccount(kid string, key []byte) Option {
+	return func(s *Server) {
+		s.acmeEAB = &acme.ExternalAccountBinding{KID: kid, Key: key}
+	}
+}
+
+// WithCertCache sets the cache used by autocert for account keys and certs,
+// by default certs are cached in the secrets directory. To share certs
+// between servers use a shared cache such as certcache.SQL.
+func WithCertCache(c autocert.Cache) Option {
+	return func(s *Server) {
+		s.certCache = c
+	}
+}
+
+// WithHostPolicy sets the policy deciding which hosts autocert requests
+// certs for, this replaces the domains passed to the StartTLSAuto methods.
+func WithHostPolicy(p autocert.HostPolicy) Option {
+	return func(s *Server) {
+		s.hostPolicy = p
+	}
+}
+
+// WithLogger sets the (deprecated) Logger for the server.
+func WithLogger(l Logger) Option {
+	return func(s *Server) {
+		s.Logger = l
+	}
+}
+
+// WithTLSConfig sets the tls config used by the StartTLS methods,
+// replacing the default config for each method.
+func WithTLSConfig(c *tls.Config) Option {
+	return func(s *Server) {
+		s.tlsConfig = c
+	}
+}
+
+// WithHandler sets the handler for requests,
+// by default http.DefaultServeMux is used.
+func WithHandler(h http.Handler) Option {
+	return func(s *Server) {
+		s.handler = h
+	}
+}
+
+// WithUpgradeSignals sets the signals which trigger Upgrade, for example
+// DefaultUpgradeSignals. Upgrades are not triggered by signals by default,
+// as Upgrade starts a new process from the current executable.
+func WithUpgradeSignals(signals ...os.Signal) Option {
+	return func(s *Server) {
+		s.upgradeSignals = signals
+	}
+}
+
+// NewWithOptions creates a new server instance configured by options.
+// Unlike New, it does not read config files, environment variables
+// or command line flags.
+func NewWithOptions(options ...Option) (*Server, error) {
+	s := &Server{
+		configProduction:  make(map[string]string),
+		configDevelopment: make(map[string]string),
+		configTest:        make(map[string]string),
+		Logger:            defaultLogger(),
+		drainTimeout:      DefaultDrainTimeout,
+		signals:           defaultSignals,
+	}
+
+	for _, option := range options {
+		option(s)
+	}
+
+	// The mode set with WithMode takes precedence over the config mode,
+	// a copy of the config is used so that the config passed is unchanged
+	if s.config != nil {
+		if s.mode != nil && *s.mode != s.config.Mode {
+			c := *s.config
+			c.Mode = *s.mode
+			s.config = &c
+		}
+		s.production = s.config.Production()
+	} else if s.mode != nil {
+		s.production = (*s.mode == config.ModeProduction)
+	}
+
+	// If no port is set, use the config port or the default
+	if s.port == 0 && s.config != nil {
+		s.port = int(s.config.GetInt("port"))
+	}
+	if s.port == 0 {
+		s.port = DefaultPort
+	}
+	if s.port < 0 || s.port > 65535 {
+		return nil, fmt.Errorf("server: invalid port %d", s.port)
+	}
+
+	return s, nil
+}
+
+// tlsConfigOr returns a clone of the tls config set with WithTLSConfig,
+// or the default given if none was set.
+func (s *Server) tlsConfigOr(defaultConfig *tls.Config) *tls.Config {
+	if s.tlsConfig != nil {
+		return s.tlsConfig.Clone()
+	}
+	return defaultConfig
+}
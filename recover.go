@@ -0,0 +1,110 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"runtime"
+	"strings"
+
+	"github.com/fragmenta/server/log"
+)
+
+// PanicHook is called with the request and the error for a recovered panic,
+// the error records the stack, for example to send panics to an error tracker.
+type PanicHook func(r *http.Request, err *StatusError)
+
+// Recoverer is a middleware which recovers from panics in handlers,
+// logs them with the stack and request trace, and renders a 500 error.
+type Recoverer struct {
+	// Hooks are called in order for each panic after it has been logged
+	Hooks []PanicHook
+
+	// ErrorHandler renders the error, DefaultErrorHandler if nil
+	ErrorHandler ErrorHandlerFunc
+}
+
+// NewRecoverer returns a Recoverer which calls the hooks given on panic.
+func NewRecoverer(hooks ...PanicHook) *Recoverer {
+	return &Recoverer{
+		Hooks: hooks,
+	}
+}
+
+// Recover recovers from panics in handlers, logging them and rendering
+// a 500 error, use NewRecoverer to add hooks.
+func Recover(h http.HandlerFunc) http.HandlerFunc {
+	return NewRecoverer().Middleware(h)
+}
+
+// Middleware recovers from panics in h. Panics with http.ErrAbortHandler
+// are not recovered, as they are used to abort a response deliberately.
+func (rc *Recoverer) Middleware(h http.HandlerFunc) http.HandlerFunc {
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		tw := &trackingWriter{ResponseWriter: w}
+
+		defer func() {
+			recovered := recover()
+			if recovered == nil {
+				return
+			}
+			if recovered == http.ErrAbortHandler {
+				panic(recovered)
+			}
+
+			err := panicError(recovered)
+			log.Error(log.V{log.MessageKey: "server: panic handling request", log.ErrorKey: err.Err, "method": r.Method, log.URLKey: r.URL.String(), log.TraceKey: log.Trace(r), "stack": err.StackTrace()})
+
+			for _, hook := range rc.Hooks {
+				hook(r, err)
+			}
+
+			// Writing an error after the header would corrupt the response
+			if tw.wroteHeader {
+				return
+			}
+			errorHandler := rc.ErrorHandler
+			if errorHandler == nil {
+				errorHandler = DefaultErrorHandler
+			}
+			errorHandler(tw, r, err)
+		}()
+
+		h(tw, r)
+	}
+
+}
+
+// panicError returns an internal error for the value recovered from a panic,
+// recording the stack and the file and line which panicked.
+// It must be called from the deferred function which recovered.
+func panicError(recovered any) *StatusError {
+	e, ok := recovered.(error)
+	if ok {
+		e = fmt.Errorf("panic: %w", e)
+	} else {
+		e = fmt.Errorf("panic: %v", recovered)
+	}
+	err := InternalError(e)
+
+	// Skip runtime.Callers, panicError and the deferred function
+	pc := make([]uintptr, maxStackDepth)
+	n := runtime.Callers(3, pc)
+	err.Stack = pc[:n]
+
+	// The first frame outside the runtime is the one which panicked
+	frames := runtime.CallersFrames(err.Stack)
+	for {
+		frame, more := frames.Next()
+		if !strings.HasPrefix(frame.Function, "runtime.") {
+			err.File = frame.File
+			err.Line = frame.Line
+			break
+		}
+		if !more {
+			break
+		}
+	}
+
+	return err
+}
@@ -0,0 +1,171 @@
+package server
+
+import (
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// Options for rewriting the www prefix of hosts in Redirector.
+const (
+	// WWWKeep leaves the host unchanged
+	WWWKeep = ""
+	// WWWAdd redirects example.com to www.example.com
+	WWWAdd = "www"
+	// WWWRemove redirects www.example.com to example.com
+	WWWRemove = "apex"
+)
+
+// acmeChallengePath is the path prefix for ACME http-01 challenges.
+const acmeChallengePath = "/.well-known/acme-challenge/"
+
+// Redirector is an http.Handler which redirects requests, typically from
+// http on port 80 to https. By default it redirects to the same host and
+// path over https with status 301.
+type Redirector struct {
+	// Scheme is the scheme to redirect to, https by default
+	Scheme string
+
+	// Host is the canonical host to redirect to, if empty the request host is used
+	Host string
+
+	// Port is the port to redirect to, if 0 the default port for the scheme is used
+	Port int
+
+	// WWW rewrites the www prefix of the host - WWWKeep, WWWAdd or WWWRemove
+	WWW string
+
+	// Path replaces the request path and query if set, e.g. / to redirect to the home page
+	Path string
+
+	// Status is the redirect status - 301, 302, 307 or 308, 301 by default
+	Status int
+
+	// ACME serves http-01 challenges if set, instead of redirecting them
+	ACME *autocert.Manager
+}
+
+// NewRedirector returns a redirector to the url given, which may include
+// a scheme and port, e.g. https://example.com. The request path is kept.
+func NewRedirector(target string) *Redirector {
+	r := &Redirector{}
+	if !strings.Contains(target, "://") {
+		target = "https://" + target
+	}
+	u, err := url.Parse(target)
+	if err != nil {
+		return r
+	}
+	r.Scheme = u.Scheme
+	r.Host = u.Hostname()
+	r.Port, _ = strconv.Atoi(u.Port())
+	return r
+}
+
+// ServeHTTP redirects the request, or passes ACME challenges through.
+func (rd *Redirector) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if rd.ACME != nil && strings.HasPrefix(r.URL.Path, acmeChallengePath) {
+		rd.ACME.HTTPHandler(http.NotFoundHandler()).ServeHTTP(w, r)
+		return
+	}
+
+	target := rd.URL(r)
+	if target == "" {
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+		return
+	}
+	http.Redirect(w, r, target, rd.status())
+}
+
+// URL returns the url to redirect the request to,
+// or an empty string if the request host is invalid.
+func (rd *Redirector) URL(r *http.Request) string {
+	scheme := rd.Scheme
+	if scheme == "" {
+		scheme = "https"
+	}
+
+	// Use the canonical host if we have one, or the request host
+	host := rd.Host
+	if host == "" {
+		host = requestHost(r)
+		if host == "" {
+			return ""
+		}
+	}
+
+	switch rd.WWW {
+	case WWWAdd:
+		if !strings.HasPrefix(host, "www.") && net.ParseIP(host) == nil {
+			host = "www." + host
+		}
+	case WWWRemove:
+		host = strings.TrimPrefix(host, "www.")
+	}
+
+	if rd.Port > 0 && !defaultPort(scheme, rd.Port) {
+		host = net.JoinHostPort(host, strconv.Itoa(rd.Port))
+	} else if strings.Contains(host, ":") {
+		// Bracket ipv6 addresses
+		host = "[" + host + "]"
+	}
+
+	u := &url.URL{
+		Scheme:   scheme,
+		Host:     host,
+		Path:     r.URL.Path,
+		RawPath:  r.URL.RawPath,
+		RawQuery: r.URL.RawQuery,
+	}
+	if rd.Path != "" {
+		u.Path = rd.Path
+		u.RawPath = ""
+		u.RawQuery = ""
+	}
+	if u.Path == "" {
+		u.Path = "/"
+	}
+
+	return u.String()
+}
+
+// status returns the redirect status, or 301 if an invalid status is set.
+func (rd *Redirector) status() int {
+	switch rd.Status {
+	case http.StatusMovedPermanently, http.StatusFound,
+		http.StatusTemporaryRedirect, http.StatusPermanentRedirect:
+		return rd.Status
+	}
+	return http.StatusMovedPermanently
+}
+
+// requestHost returns the host from the request without a port,
+// or an empty string if it is not a valid host name or ip.
+func requestHost(r *http.Request) string {
+	host := r.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.ToLower(strings.Trim(host, "[]"))
+	if host == "" {
+		return ""
+	}
+	if net.ParseIP(host) != nil {
+		return host
+	}
+	for _, c := range host {
+		if !(c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '-' || c == '.') {
+			return ""
+		}
+	}
+	return host
+}
+
+// defaultPort returns true if port is the default for scheme.
+func defaultPort(scheme string, port int) bool {
+	return (scheme == "https" && port == 443) || (scheme == "http" && port == 80)
+}
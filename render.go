@@ -0,0 +1,183 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"html/template"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/fragmenta/server/config"
+	"github.com/fragmenta/server/log"
+)
+
+// Media types negotiated by RenderError.
+const (
+	mediaHTML    = "text/html"
+	mediaJSON    = "application/json"
+	mediaProblem = "application/problem+json"
+)
+
+// ErrorTemplate is used by RenderError to render errors as html, it is
+// executed with a *Problem. Apps may replace it with their own template.
+var ErrorTemplate = template.Must(template.New("error").Parse(`<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>{{.Title}}</title></head>
+<body>
+<h1>{{.Title}}</h1>
+<p>{{.Detail}}</p>
+{{if .Errors}}<ul>{{range $field, $messages := .Errors}}{{range $messages}}<li>{{$field}}: {{.}}</li>{{end}}{{end}}</ul>{{end}}
+{{if .Error}}<pre>{{.Error}}{{if .File}}
+{{.File}}:{{.Line}}{{end}}{{if .Stack}}
+
+{{.Stack}}{{end}}</pre>{{end}}
+{{if .Trace}}<p><small>Trace: {{.Trace}}</small></p>{{end}}
+</body>
+</html>
+`))
+
+// Problem describes an error for display, it is encoded as
+// application/problem+json as described in RFC 9457.
+// Error, File, Line and Stack are only set in development or test.
+type Problem struct {
+	Type   string `json:"type,omitempty"`
+	Title  string `json:"title"`
+	Status int    `json:"status"`
+	Detail string `json:"detail,omitempty"`
+
+	// Instance is the path of the request which failed
+	Instance string `json:"instance,omitempty"`
+
+	// Trace is the request id set by the log middleware
+	Trace string `json:"trace,omitempty"`
+
+	// Errors holds messages for invalid fields by field name
+	Errors map[string][]string `json:"errors,omitempty"`
+
+	Error string `json:"error,omitempty"`
+	File  string `json:"file,omitempty"`
+	Line  int    `json:"line,omitempty"`
+	Stack string `json:"stack,omitempty"`
+}
+
+// NewProblem returns a Problem describing err for the request. The
+// underlying error is only shown if config.Current is loaded for
+// development or test, so that it is hidden if config is missing.
+func NewProblem(r *http.Request, err error) *Problem {
+	e := statusError(err)
+	p := &Problem{
+		Title:    e.Title,
+		Status:   e.Status,
+		Detail:   e.Message,
+		Instance: r.URL.Path,
+		Trace:    log.Trace(r),
+		Errors:   e.Fields,
+	}
+	if p.Title == "" {
+		p.Title = http.StatusText(e.Status)
+	}
+	if config.Development() || config.Testing() {
+		if e.Err != nil {
+			p.Error = e.Err.Error()
+		}
+		p.File = e.File
+		p.Line = e.Line
+		p.Stack = e.StackTrace()
+	}
+	return p
+}
+
+// RenderError writes err to the response as html, json or problem+json
+// depending on the Accept header of the request. Errors which are not
+// a *StatusError are rendered as 500 Internal Server Error.
+func RenderError(w http.ResponseWriter, r *http.Request, err error) {
+	e := statusError(err)
+	p := NewProblem(r, e)
+
+	var body []byte
+	mediaType := negotiateMedia(r.Header.Get("Accept"), mediaHTML, mediaProblem, mediaJSON)
+	if mediaType == mediaHTML {
+		var buf bytes.Buffer
+		err = ErrorTemplate.Execute(&buf, p)
+		if err != nil {
+			log.Error(log.V{log.MessageKey: "server: error rendering error template", log.ErrorKey: err, log.TraceKey: p.Trace})
+			http.Error(w, p.Title, p.Status)
+			return
+		}
+		body = buf.Bytes()
+		mediaType += "; charset=utf-8"
+	} else {
+		body, err = json.Marshal(p)
+		if err != nil {
+			http.Error(w, p.Title, p.Status)
+			return
+		}
+	}
+
+	header := w.Header()
+	header.Del("Content-Length")
+	header.Del("Content-Encoding")
+	header.Set("Content-Type", mediaType)
+	header.Set("X-Content-Type-Options", "nosniff")
+	if e.RetryAfter > 0 {
+		header.Set("Retry-After", strconv.Itoa(int(math.Ceil(e.RetryAfter.Seconds()))))
+	}
+	w.WriteHeader(p.Status)
+	w.Write(body)
+}
+
+// negotiateMedia returns the media type from those offered which has
+// the highest quality in the Accept header. The first type offered is
+// returned if the header is empty or none are acceptable.
+func negotiateMedia(accept string, offers ...string) string {
+	best, bestQ := offers[0], 0.0
+	for _, offer := range offers {
+		q := mediaQuality(accept, offer)
+		if q > bestQ {
+			best, bestQ = offer, q
+		}
+	}
+	return best
+}
+
+// mediaQuality returns the quality given for mediaType in the Accept header,
+// using the most specific match, or 0 if it is not acceptable.
+func mediaQuality(accept, mediaType string) float64 {
+	mainType, _, _ := strings.Cut(mediaType, "/")
+	quality, specificity := 0.0, 0
+	for _, part := range strings.Split(accept, ",") {
+		name, params, _ := strings.Cut(part, ";")
+		name = strings.ToLower(strings.TrimSpace(name))
+
+		s := 0
+		switch name {
+		case mediaType:
+			s = 3
+		case mainType + "/*":
+			s = 2
+		case "*/*":
+			s = 1
+		default:
+			continue
+		}
+		if s < specificity {
+			continue
+		}
+
+		q := 1.0
+		for _, param := range strings.Split(params, ";") {
+			value, ok := strings.CutPrefix(strings.TrimSpace(param), "q=")
+			if ok {
+				var err error
+				q, err = strconv.ParseFloat(value, 64)
+				if err != nil {
+					q = 0
+				}
+			}
+		}
+		quality, specificity = q, s
+	}
+	return quality
+}
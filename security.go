@@ -0,0 +1,186 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"net/http"
+	"strings"
+
+	"github.com/fragmenta/server/config"
+)
+
+// NoncePlaceholder is replaced in the CSP by a random nonce for each request,
+// e.g. script-src 'nonce-{nonce}'. Templates can read the nonce with CSPNonce.
+const NoncePlaceholder = "{nonce}"
+
+// Config keys read by SecurityHeadersFromConfig, values override the preset.
+const (
+	// ConfigSecurityPreset selects the preset - strict or moderate (the default)
+	ConfigSecurityPreset            = "security_preset"
+	ConfigSecurityHSTS              = "security_hsts"
+	ConfigSecurityCSP               = "security_csp"
+	ConfigSecurityReportOnly        = "security_csp_report_only"
+	ConfigSecurityFrameOptions      = "security_frame_options"
+	ConfigSecurityReferrerPolicy    = "security_referrer_policy"
+	ConfigSecurityPermissionsPolicy = "security_permissions_policy"
+	ConfigSecurityCOOP              = "security_coop"
+	ConfigSecurityCOEP              = "security_coep"
+)
+
+// SecurityHeaders sets security headers on responses, use a preset like
+// StrictSecurityHeaders and adjust it, or read it from config.
+// Empty values are not sent.
+type SecurityHeaders struct {
+	// HSTS is the Strict-Transport-Security header
+	HSTS string
+
+	// CSP is the Content-Security-Policy header, which may contain NoncePlaceholder
+	CSP string
+
+	// ReportOnly sends the CSP as Content-Security-Policy-Report-Only
+	ReportOnly bool
+
+	// ContentTypeOptions is the X-Content-Type-Options header
+	ContentTypeOptions string
+
+	// FrameOptions is the X-Frame-Options header
+	FrameOptions string
+
+	// ReferrerPolicy is the Referrer-Policy header
+	ReferrerPolicy string
+
+	// PermissionsPolicy is the Permissions-Policy header
+	PermissionsPolicy string
+
+	// CrossOriginOpenerPolicy is the Cross-Origin-Opener-Policy header
+	CrossOriginOpenerPolicy string
+
+	// CrossOriginEmbedderPolicy is the Cross-Origin-Embedder-Policy header
+	CrossOriginEmbedderPolicy string
+}
+
+// StrictSecurityHeaders returns a preset suitable for apps which serve
+// all their own scripts and styles, and use nonces for inline scripts.
+func StrictSecurityHeaders() *SecurityHeaders {
+	return &SecurityHeaders{
+		HSTS:                      "max-age=63072000; includeSubDomains; preload",
+		CSP:                       "default-src 'self'; script-src 'self' 'nonce-{nonce}'; style-src 'self' 'nonce-{nonce}'; img-src 'self' data:; object-src 'none'; base-uri 'self'; form-action 'self'; frame-ancestors 'none'",
+		ContentTypeOptions:        "nosniff",
+		FrameOptions:              "DENY",
+		ReferrerPolicy:            "no-referrer",
+		PermissionsPolicy:         "camera=(), microphone=(), geolocation=(), payment=()",
+		CrossOriginOpenerPolicy:   "same-origin",
+		CrossOriginEmbedderPolicy: "require-corp",
+	}
+}
+
+// ModerateSecurityHeaders returns a preset suitable for most apps,
+// which allows inline styles and images from other sites.
+func ModerateSecurityHeaders() *SecurityHeaders {
+	return &SecurityHeaders{
+		HSTS:                    "max-age=31536000",
+		CSP:                     "default-src 'self'; script-src 'self' 'nonce-{nonce}'; style-src 'self' 'unsafe-inline'; img-src * data:; object-src 'none'; base-uri 'self'; frame-ancestors 'self'",
+		ContentTypeOptions:      "nosniff",
+		FrameOptions:            "SAMEORIGIN",
+		ReferrerPolicy:          "strict-origin-when-cross-origin",
+		CrossOriginOpenerPolicy: "same-origin-allow-popups",
+	}
+}
+
+// SecurityHeadersFromConfig returns the preset named in config (moderate
+// by default) with any values set in config replacing those of the preset.
+// A value of none removes the header.
+func SecurityHeadersFromConfig(c *config.Config) *SecurityHeaders {
+	sh := ModerateSecurityHeaders()
+	if c.Get(ConfigSecurityPreset) == "strict" {
+		sh = StrictSecurityHeaders()
+	}
+
+	set := func(key string, value *string) {
+		switch v := c.Get(key); v {
+		case "":
+		case "none":
+			*value = ""
+		default:
+			*value = v
+		}
+	}
+	set(ConfigSecurityHSTS, &sh.HSTS)
+	set(ConfigSecurityCSP, &sh.CSP)
+	set(ConfigSecurityFrameOptions, &sh.FrameOptions)
+	set(ConfigSecurityReferrerPolicy, &sh.ReferrerPolicy)
+	set(ConfigSecurityPermissionsPolicy, &sh.PermissionsPolicy)
+	set(ConfigSecurityCOOP, &sh.CrossOriginOpenerPolicy)
+	set(ConfigSecurityCOEP, &sh.CrossOriginEmbedderPolicy)
+	sh.ReportOnly = c.GetBool(ConfigSecurityReportOnly)
+
+	return sh
+}
+
+// Middleware sets the security headers on responses, generating a CSP nonce
+// for each request if the CSP uses one.
+func (sh *SecurityHeaders) Middleware(h http.HandlerFunc) http.HandlerFunc {
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		header := w.Header()
+
+		if sh.CSP != "" {
+			csp := sh.CSP
+			if strings.Contains(csp, NoncePlaceholder) {
+				nonce := newNonce()
+				csp = strings.ReplaceAll(csp, NoncePlaceholder, nonce)
+				r = setCSPNonce(r, nonce)
+			}
+			if sh.ReportOnly {
+				header.Set("Content-Security-Policy-Report-Only", csp)
+			} else {
+				header.Set("Content-Security-Policy", csp)
+			}
+		}
+
+		setHeader(header, "Strict-Transport-Security", sh.HSTS)
+		setHeader(header, "X-Content-Type-Options", sh.ContentTypeOptions)
+		setHeader(header, "X-Frame-Options", sh.FrameOptions)
+		setHeader(header, "Referrer-Policy", sh.ReferrerPolicy)
+		setHeader(header, "Permissions-Policy", sh.PermissionsPolicy)
+		setHeader(header, "Cross-Origin-Opener-Policy", sh.CrossOriginOpenerPolicy)
+		setHeader(header, "Cross-Origin-Embedder-Policy", sh.CrossOriginEmbedderPolicy)
+
+		h(w, r)
+	}
+
+}
+
+// setHeader sets the header key to value if value is not empty.
+func setHeader(header http.Header, key, value string) {
+	if value != "" {
+		header.Set(key, value)
+	}
+}
+
+type cspNonceKey struct{}
+
+// CSPNonce returns the CSP nonce for this request set by the security
+// headers middleware, for use in script and style tags in templates,
+// or an empty string if none was set.
+func CSPNonce(r *http.Request) string {
+	nonce, ok := r.Context().Value(cspNonceKey{}).(string)
+	if ok {
+		return nonce
+	}
+	return ""
+}
+
+// setCSPNonce saves the nonce in the request context.
+func setCSPNonce(r *http.Request, nonce string) *http.Request {
+	ctx := context.WithValue(r.Context(), cspNonceKey{}, nonce)
+	return r.WithContext(ctx)
+}
+
+// newNonce returns a new random nonce, base64 encoded.
+func newNonce() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return base64.StdEncoding.EncodeToString(b)
+}
@@ -4,13 +4,19 @@ package server
 import (
 	"crypto/tls"
 	"fmt"
-	"log"
+	stdlog "log"
+	"net"
 	"net/http"
 	"os"
-	"strings"
+	"slices"
+	"sync"
 	"time"
 
+	"golang.org/x/crypto/acme"
 	"golang.org/x/crypto/acme/autocert"
+
+	"github.com/fragmenta/server/config"
+	"github.com/fragmenta/server/log"
 )
 
 // Server wraps the stdlib http server and x/autocert pkg with some setup.
@@ -19,10 +25,47 @@ type Server struct {
 	// Which port to serve on - in 2.0 pass as argument for New()
 	port int
 
+	// Which addresses to bind to, if empty all interfaces are used
+	bind []bindAddress
+
+	// The listener or listen spec for the main server, if not set Addr is used
+	listener net.Listener
+	listen   string
+
+	// The handler for requests, if nil http.DefaultServeMux is used
+	handler http.Handler
+
+	// The config set with WithConfig, if nil the deprecated configs are used
+	config *config.Config
+
+	// Timeouts and limits for the http servers started
+	timeouts Timeouts
+	limits   Limits
+
+	// The tls config set with WithTLSConfig, if nil defaults are used
+	tlsConfig *tls.Config
+
+	// The interval at which cert files are checked for changes
+	certReloadInterval time.Duration
+
+	// The CA bundle and mode for client cert authentication
+	clientCA   string
+	clientAuth tls.ClientAuthType
+
+	// Autocert settings, if not set these are read from config
+	acmeDirectory string
+	acmeClient    *acme.Client
+	acmeEAB       *acme.ExternalAccountBinding
+	certCache     autocert.Cache
+	hostPolicy    autocert.HostPolicy
+
 	// Which mode we're in, read from ENV variable
 	// Deprecated - due to be removed in 2.0
 	production bool
 
+	// The mode set with WithMode, if nil the config mode is used
+	mode *int
+
 	// Deprecated Logging - due to be removed in 2.0
 	// Instead use the structured logging with server/log
 	Logger Logger
@@ -33,30 +76,50 @@ type Server struct {
 	configProduction  map[string]string
 	configDevelopment map[string]string
 	configTest        map[string]string
+
+	// mu protects the lifecycle fields below
+	mu sync.Mutex
+
+	// drainTimeout is the time allowed for requests to complete on shutdown
+	drainTimeout time.Duration
+
+	// signals trigger a graceful shutdown when received
+	signals         []os.Signal
+	handlingSignals bool
+
+	// servers are the http servers started, including redirect servers
+	servers []*http.Server
+
+	// listeners are the listeners opened by name, for handover on upgrade
+	listeners map[string]net.Listener
+
+	// upgradeSignals trigger an Upgrade when received
+	upgradeSignals   []os.Signal
+	handlingUpgrades bool
+	upgrading        bool
+
+	// hooks are called in order on shutdown
+	hooks []ShutdownHook
+
+	// shutdown is set once Shutdown has been called, done is closed when it completes
+	shutdown bool
+	done     chan struct{}
 }
 
-// New creates a new server instance
+// New creates a new server instance, reading the environment from the
+// FRAG_ENV environment variable, config from secrets/fragmenta.json and
+// the port from the -p flag. Use NewWithOptions to avoid this hidden I/O.
 func New() (*Server, error) {
 
-	// Check environment variable to see if we are in production mode
-	prod := false
-	if os.Getenv("FRAG_ENV") == "production" {
-		prod = true
-	}
-
-	// Set up a new server
-	s := &Server{
-		port:              3000,
-		production:        prod,
-		configProduction:  make(map[string]string),
-		configDevelopment: make(map[string]string),
-		configTest:        make(map[string]string),
-		Logger:            log.New(os.Stderr, "fragmenta: ", log.LstdFlags),
+	// The config selects the environment from FRAG_ENV
+	s, err := NewWithOptions(WithConfig(config.New()))
+	if err != nil {
+		return s, err
 	}
 
 	// Old style config read - this will be going away in Fragmenta 2.0
 	// use server/config instead from the app
-	err := s.readConfig()
+	err = s.readConfig()
 	if err != nil {
 		return s, err
 	}
@@ -68,6 +131,11 @@ func New() (*Server, error) {
 	return s, err
 }
 
+// defaultLogger returns the deprecated default logger writing to stderr
+func defaultLogger() Logger {
+	return stdlog.New(os.Stderr, "fragmenta: ", stdlog.LstdFlags)
+}
+
 // Port returns the port of the server
 func (s *Server) Port() int {
 	return s.port
@@ -78,199 +146,263 @@ func (s *Server) PortString() string {
 	return fmt.Sprintf(":%d", s.port)
 }
 
-// Start starts an http server on the given port
-func (s *Server) Start() error {
-	server := &http.Server{
-		// Set the port in the preferred string format
-		Addr: s.PortString(),
-
-		// The default server from net/http has no timeouts - set some limits
-		ReadHeaderTimeout: 30 * time.Second,
-		ReadTimeout:       60 * time.Second,
-		WriteTimeout:      60 * time.Second,
-		IdleTimeout:       10 * time.Second, // IdleTimeout was introduced in Go 1.8
+// Addr returns the first host and port to listen on,
+// if no host is set this is the same as PortString.
+func (s *Server) Addr() string {
+	return s.Addresses()[0]
+}
 
+// Start starts an http server on the given port, or the listener set in
+// options or config. It blocks until the server stops and returns nil
+// if the server was stopped with Shutdown.
+func (s *Server) Start() error {
+	listeners, err := s.mainListeners()
+	if err != nil {
+		return err
 	}
-	return server.ListenAndServe()
+
+	server := s.httpServer(listeners[0].Addr().String(), s.handler, nil)
+	return s.serve(server, listeners, func() error {
+		return serveAll(server, listeners, false)
+	})
 }
 
 // StartTLS starts an https server on the given port
 // with tls cert/key from config keys.
+// The cert and key files are reloaded if they change on disk.
 func (s *Server) StartTLS(cert, key string) error {
 
-	// Set up a new http server
-	server := &http.Server{
-		// Set the port in the preferred string format
-		Addr: s.PortString(),
-
-		// The default server from net/http has no timeouts - set some limits
-		ReadHeaderTimeout: 30 * time.Second,
-		ReadTimeout:       60 * time.Second,
-		WriteTimeout:      60 * time.Second,
-		IdleTimeout:       10 * time.Second, // IdleTimeout was introduced in Go 1.8
-
-		// This TLS config follows recommendations in the above article
-		TLSConfig: &tls.Config{
-			// VersionTLS12 would exclude many browsers
-			// inc. Android 4.x, IE 10, Opera 12.17, Safari 6
-			// So unfortunately not acceptable as a default yet
-			// Current default here for clarity
-			MinVersion: tls.VersionTLS10,
-
-			// Causes servers to use Go's default ciphersuite preferences,
-			// which are tuned to avoid attacks. Does nothing on clients.
-			PreferServerCipherSuites: true,
-			// Only use curves which have assembly implementations
-			CurvePreferences: []tls.CurveID{
-				tls.CurveP256,
-				tls.X25519, // Go 1.8 only
-			},
+	// This TLS config follows recommendations in the above article
+	// unless a config was set with WithTLSConfig
+	tlsConfig := s.tlsConfigOr(&tls.Config{
+		// VersionTLS12 would exclude many browsers
+		// inc. Android 4.x, IE 10, Opera 12.17, Safari 6
+		// So unfortunately not acceptable as a default yet
+		// Current default here for clarity
+		MinVersion: tls.VersionTLS10,
+
+		// Causes servers to use Go's default ciphersuite preferences,
+		// which are tuned to avoid attacks. Does nothing on clients.
+		PreferServerCipherSuites: true,
+		// Only use curves which have assembly implementations
+		CurvePreferences: []tls.CurveID{
+			tls.CurveP256,
+			tls.X25519, // Go 1.8 only
 		},
+	})
+
+	// Require client certs if set in options or config
+	err := s.applyClientAuth(tlsConfig)
+	if err != nil {
+		return err
+	}
+
+	// Load the cert and key, they are reloaded if they change once serving
+	reloader, err := NewCertReloader(cert, key)
+	if err != nil {
+		return err
 	}
+	tlsConfig.GetCertificate = reloader.GetCertificate
 
-	return server.ListenAndServeTLS(cert, key)
+	listeners, err := s.mainListeners()
+	if err != nil {
+		return err
+	}
+
+	server := s.httpServer(listeners[0].Addr().String(), s.handler, tlsConfig)
+	return s.serve(server, listeners, func() error {
+		s.watchCerts(reloader)
+		return serveAll(server, listeners, true)
+	})
 }
 
 // StartTLSModern starts an https server on the given port
-// with tls cert/key from config keys.
+// with tls cert/key from config keys, which are reloaded if they change.
 // TLS version is restricted to VersionTLS12 and cipher suites to known secure ones
 // this attains an A+ score at https://www.ssllabs.com/
 // while remaining compatible with most older clients
 func (s *Server) StartTLSModern(cert, key string) error {
 
-	// Set up a new http server
-	server := &http.Server{
-		// Set the port in the preferred string format
-		Addr: s.PortString(),
-
-		// The default server from net/http has no timeouts - set some limits
-		ReadHeaderTimeout: 30 * time.Second,
-		ReadTimeout:       60 * time.Second,
-		WriteTimeout:      60 * time.Second,
-		IdleTimeout:       10 * time.Second, // IdleTimeout was introduced in Go 1.8
-
-		// This TLS config follows recommendations in the above article
-		TLSConfig: &tls.Config{
-			// Require VersionTLS12 - this will exclude older browsers like Safari 5, IE 6
-			// As of 2020 all browsers require this version because of vulnerabilities in 1.1
-			MinVersion: tls.VersionTLS12,
-			// Use Go's default ciphersuite preferences, which are tuned to avoid attacks.
-			PreferServerCipherSuites: true,
-			// Limit Curves to known secure ones
-			CurvePreferences: []tls.CurveID{tls.CurveP521, tls.CurveP384, tls.CurveP256},
-			// Limit CipherSuites to known secure ones
-			// TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA256 is included for compatability reasons
-			CipherSuites: []uint16{
-				tls.TLS_CHACHA20_POLY1305_SHA256,
-				tls.TLS_AES_256_GCM_SHA384,
-				tls.TLS_AES_128_GCM_SHA256,
-				tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
-				tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
-				tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
-				tls.TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA256,
-			},
+	// This TLS config follows recommendations in the above article
+	// unless a config was set with WithTLSConfig
+	tlsConfig := s.tlsConfigOr(&tls.Config{
+		// Require VersionTLS12 - this will exclude older browsers like Safari 5, IE 6
+		// As of 2020 all browsers require this version because of vulnerabilities in 1.1
+		MinVersion: tls.VersionTLS12,
+		// Use Go's default ciphersuite preferences, which are tuned to avoid attacks.
+		PreferServerCipherSuites: true,
+		// Limit Curves to known secure ones
+		CurvePreferences: []tls.CurveID{tls.CurveP521, tls.CurveP384, tls.CurveP256},
+		// Limit CipherSuites to known secure ones
+		// TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA256 is included for compatability reasons
+		CipherSuites: []uint16{
+			tls.TLS_CHACHA20_POLY1305_SHA256,
+			tls.TLS_AES_256_GCM_SHA384,
+			tls.TLS_AES_128_GCM_SHA256,
+			tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+			tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+			tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+			tls.TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA256,
 		},
+	})
+
+	// Require client certs if set in options or config
+	err := s.applyClientAuth(tlsConfig)
+	if err != nil {
+		return err
+	}
+
+	// Load the cert and key, they are reloaded if they change once serving
+	reloader, err := NewCertReloader(cert, key)
+	if err != nil {
+		return err
 	}
+	tlsConfig.GetCertificate = reloader.GetCertificate
 
-	return server.ListenAndServeTLS(cert, key)
+	listeners, err := s.mainListeners()
+	if err != nil {
+		return err
+	}
+
+	server := s.httpServer(listeners[0].Addr().String(), s.handler, tlsConfig)
+	return s.serve(server, listeners, func() error {
+		s.watchCerts(reloader)
+		return serveAll(server, listeners, true)
+	})
 }
 
 // StartTLSAuto starts an https server on the given port
 // by requesting certs from an ACME provider using the http-01 challenge.
 // it also starts a server on the port 80 to listen for challenges and redirect
 // The server must be on a public IP which matches the
-// DNS for the domains.
+// DNS for the domains. The ACME directory, cache and host policy
+// may be set in options or config.
 func (s *Server) StartTLSAuto(email, domains string) error {
-	autocertDomains := strings.Split(domains, " ")
-	certManager := &autocert.Manager{
-		Prompt:     autocert.AcceptTOS,
-		Email:      email,                                      // Email for problems with certs
-		HostPolicy: autocert.HostWhitelist(autocertDomains...), // Domains to request certs for
-		Cache:      autocert.DirCache("secrets"),               // Cache certs in secrets folder
+	certManager, err := s.certManager(email, domains)
+	if err != nil {
+		return err
 	}
-	// Handle all :80 traffic using autocert to allow http-01 challenge responses
-	go func() {
-		http.ListenAndServe(":80", certManager.HTTPHandler(nil))
-	}()
 
 	server := s.ConfiguredTLSServer(certManager)
-	return server.ListenAndServeTLS("", "")
+	err = s.applyClientAuth(server.TLSConfig)
+	if err != nil {
+		return err
+	}
+
+	// Open all listeners before serving, so that nothing is left serving on error
+	listeners, err := s.mainListeners()
+	if err != nil {
+		return err
+	}
+
+	// Handle all :80 traffic using autocert to allow http-01 challenge responses
+	challengeListeners, err := s.listenAll(listenerACME, s.addressesFor(80))
+	if err != nil {
+		s.closeListeners(listeners)
+		return err
+	}
+	redirector := &Redirector{
+		ACME:   certManager,
+		Status: http.StatusFound,
+	}
+	challengeServer := s.httpServer(":80", redirector, nil)
+	s.serveBackground(challengeServer, challengeListeners, func() error {
+		return serveAll(challengeServer, challengeListeners, false)
+	})
+
+	return s.serve(server, listeners, func() error {
+		return serveAll(server, listeners, true)
+	})
 }
 
 // StartTLSAutocert starts an https server on the given port
-// by requesting certs from an ACME provider.
+// by requesting certs from an ACME provider using the tls-alpn-01 challenge.
 // The server must be on a public IP which matches the
-// DNS for the domains.
+// DNS for the domains. The ACME directory, cache and host policy
+// may be set in options or config.
 func (s *Server) StartTLSAutocert(email string, domains string) error {
-	autocertDomains := strings.Split(domains, " ")
-	certManager := &autocert.Manager{
-		Prompt:     autocert.AcceptTOS,
-		Email:      email,                                      // Email for problems with certs
-		HostPolicy: autocert.HostWhitelist(autocertDomains...), // Domains to request certs for
-		Cache:      autocert.DirCache("secrets"),               // Cache certs in secrets folder
+	certManager, err := s.certManager(email, domains)
+	if err != nil {
+		return err
 	}
+
 	server := s.ConfiguredTLSServer(certManager)
-	return server.ListenAndServeTLS("", "")
+	err = s.applyClientAuth(server.TLSConfig)
+	if err != nil {
+		return err
+	}
+
+	listeners, err := s.mainListeners()
+	if err != nil {
+		return err
+	}
+	return s.serve(server, listeners, func() error {
+		return serveAll(server, listeners, true)
+	})
 }
 
 // ConfiguredTLSServer returns a TLS server instance with a secure config
-// this server has read/write timeouts set to 20 seconds,
+// this server has the timeouts and limits set in options or config,
 // prefers server cipher suites and only uses certain accelerated curves
 // see - https://blog.gopheracademy.com/advent-2016/exposing-go-on-the-internet/
 func (s *Server) ConfiguredTLSServer(certManager *autocert.Manager) *http.Server {
 
-	return &http.Server{
-		// Set the port in the preferred string format
-		Addr: s.PortString(),
-
-		// The default server from net/http has no timeouts - set some limits
-		ReadHeaderTimeout: 30 * time.Second,
-		ReadTimeout:       60 * time.Second,
-		WriteTimeout:      60 * time.Second,
-		IdleTimeout:       10 * time.Second, // IdleTimeout was introduced in Go 1.8
-
-		// This TLS config follows recommendations in the above article
-		TLSConfig: &tls.Config{
-			// Pass in a cert manager if you want one set
-			// this will only be used if the server Certificates are empty
-			GetCertificate: certManager.GetCertificate,
-
-			// VersionTLS11 or VersionTLS12 would exclude many browsers
-			// inc. Android 4.x, IE 10, Opera 12.17, Safari 6
-			// So unfortunately not acceptable as a default yet
-			// Current default here for clarity
-			MinVersion: tls.VersionTLS10,
-
-			// Causes servers to use Go's default ciphersuite preferences,
-			// which are tuned to avoid attacks. Does nothing on clients.
-			PreferServerCipherSuites: true,
-			// Only use curves which have assembly implementations
-			CurvePreferences: []tls.CurveID{
-				tls.CurveP256,
-				tls.X25519, // Go 1.8 only
-			},
+	// This TLS config follows recommendations in the above article
+	// unless a config was set with WithTLSConfig
+	tlsConfig := s.tlsConfigOr(&tls.Config{
+		// VersionTLS11 or VersionTLS12 would exclude many browsers
+		// inc. Android 4.x, IE 10, Opera 12.17, Safari 6
+		// So unfortunately not acceptable as a default yet
+		// Current default here for clarity
+		MinVersion: tls.VersionTLS10,
+
+		// Causes servers to use Go's default ciphersuite preferences,
+		// which are tuned to avoid attacks. Does nothing on clients.
+		PreferServerCipherSuites: true,
+		// Only use curves which have assembly implementations
+		CurvePreferences: []tls.CurveID{
+			tls.CurveP256,
+			tls.X25519, // Go 1.8 only
 		},
+	})
+
+	// Pass in a cert manager if you want one set
+	// this will only be used if the server Certificates are empty
+	tlsConfig.GetCertificate = certManager.GetCertificate
+
+	// Accept the tls-alpn-01 challenge protocol as well as http,
+	// without repeating protocols already set with WithTLSConfig
+	for _, proto := range []string{"h2", "http/1.1", acme.ALPNProto} {
+		if !slices.Contains(tlsConfig.NextProtos, proto) {
+			tlsConfig.NextProtos = append(tlsConfig.NextProtos, proto)
+		}
 	}
 
+	return s.httpServer(s.Addr(), s.handler, tlsConfig)
 }
 
 // StartRedirectAll starts redirecting all requests on the given port to the given host
 // this should be called before StartTLS if redirecting http on port 80 to https
+// The redirect server listens on the same hosts as the main server,
+// and is stopped along with the main server on Shutdown.
 func (s *Server) StartRedirectAll(p int, host string) {
-	port := fmt.Sprintf(":%d", p)
-	// Listen and server on port p in a separate goroutine
-	go func() {
-		http.ListenAndServe(port, &redirectHandler{host: host})
-	}()
+	s.StartRedirect(p, NewRedirector(host))
 }
 
-// redirectHandler is useful if serving tls direct (not behind a proxy)
-// and a redirect from port 80 is required.
-type redirectHandler struct {
-	host string
-}
+// StartRedirect starts redirecting all requests on the given port using
+// the redirector given, which may rewrite the host and path, and
+// pass ACME challenges through to autocert.
+func (s *Server) StartRedirect(p int, redirector *Redirector) {
+	// Listen on port p on the same hosts as the main server
+	listeners, err := s.listenAll(listenerRedirect, s.addressesFor(p))
+	if err != nil {
+		log.Error(log.V{log.MessageKey: "server: error starting redirect", "port": p, log.ErrorKey: err})
+		return
+	}
 
-// ServeHTTP on this handler simply redirects to the main site
-func (m *redirectHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	http.Redirect(w, r, m.host+r.URL.String(), http.StatusMovedPermanently)
+	server := s.httpServer(fmt.Sprintf(":%d", p), redirector, nil)
+	// Serve on port p in a separate goroutine
+	s.serveBackground(server, listeners, func() error {
+		return serveAll(server, listeners, false)
+	})
 }
@@ -0,0 +1,485 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+
+	"github.com/fragmenta/server/config"
+)
+
+// freePort returns a port which is free to listen on.
+func freePort(t *testing.T) int {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("server: error finding free port %s", err)
+	}
+	defer l.Close()
+	return l.Addr().(*net.TCPAddr).Port
+}
+
+// TestShutdown tests that in-flight requests complete and hooks are called in order on Shutdown.
+func TestShutdown(t *testing.T) {
+	started := make(chan struct{})
+	mux := http.NewServeMux()
+	mux.HandleFunc("/test/shutdown", func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		time.Sleep(100 * time.Millisecond)
+		w.Write([]byte("drained"))
+	})
+
+	s := &Server{port: freePort(t), handler: mux}
+	var calls []string
+	s.OnShutdown(func(ctx context.Context) error {
+		calls = append(calls, "first")
+		return nil
+	})
+	s.OnShutdown(func(ctx context.Context) error {
+		calls = append(calls, "second")
+		return nil
+	})
+
+	startErr := make(chan error, 1)
+	go func() {
+		startErr <- s.Start()
+	}()
+
+	// Make a slow request, and shut down while it is in flight
+	body := make(chan string, 1)
+	go func() {
+		var resp *http.Response
+		var err error
+		for range 50 {
+			resp, err = http.Get("http://127.0.0.1" + s.PortString() + "/test/shutdown")
+			if err == nil {
+				break
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		if err != nil {
+			body <- err.Error()
+			return
+		}
+		defer resp.Body.Close()
+		b, _ := io.ReadAll(resp.Body)
+		body <- string(b)
+	}()
+
+	select {
+	case <-started:
+	case <-time.After(2 * time.Second):
+		t.Fatalf("server: request did not start")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	err := s.Shutdown(ctx)
+	if err != nil {
+		t.Fatalf("server: error shutting down %s", err)
+	}
+
+	if got := <-body; got != "drained" {
+		t.Fatalf("server: in-flight request not drained got:%s", got)
+	}
+
+	if err := <-startErr; err != nil {
+		t.Fatalf("server: start returned error after shutdown %s", err)
+	}
+
+	if len(calls) != 2 || calls[0] != "first" || calls[1] != "second" {
+		t.Fatalf("server: hooks not called in order got:%v", calls)
+	}
+}
+
+// TestNewWithOptions tests options are applied without reading files or flags.
+func TestNewWithOptions(t *testing.T) {
+	s, err := NewWithOptions()
+	if err != nil {
+		t.Fatalf("server: error creating server %s", err)
+	}
+	if s.Port() != DefaultPort || s.Production() {
+		t.Fatalf("server: unexpected defaults port:%d production:%v", s.Port(), s.Production())
+	}
+	if len(s.upgradeSignals) != 0 {
+		t.Fatalf("server: upgrade signals set by default got:%v", s.upgradeSignals)
+	}
+
+	c := config.New()
+	err = c.Load("config/testdata/config.json")
+	if err != nil {
+		t.Fatalf("server: error loading config %s", err)
+	}
+	c.Mode = config.ModeProduction
+
+	s, err = NewWithOptions(WithConfig(c), WithAddress("127.0.0.1"))
+	if err != nil {
+		t.Fatalf("server: error creating server %s", err)
+	}
+	if s.Port() != 80 || !s.Production() || s.Addr() != "127.0.0.1:80" {
+		t.Fatalf("server: config not applied port:%d production:%v addr:%s", s.Port(), s.Production(), s.Addr())
+	}
+	if s.Config("root_url") != "https://golangnews.com" {
+		t.Fatalf("server: config not used got:%s", s.Config("root_url"))
+	}
+
+	s, err = NewWithOptions(WithConfig(c), WithPort(4000), WithMode(config.ModeDevelopment))
+	if err != nil {
+		t.Fatalf("server: error creating server %s", err)
+	}
+	if s.Port() != 4000 || s.Production() {
+		t.Fatalf("server: options not applied port:%d production:%v", s.Port(), s.Production())
+	}
+
+	_, err = NewWithOptions(WithPort(-1))
+	if err == nil {
+		t.Fatalf("server: no error for invalid port")
+	}
+}
+
+// TestModeOptions tests WithMode takes precedence over WithConfig in any order.
+func TestModeOptions(t *testing.T) {
+	load := func(mode int) *config.Config {
+		c := config.New()
+		err := c.Load("config/testdata/config.json")
+		if err != nil {
+			t.Fatalf("server: error loading config %s", err)
+		}
+		c.Mode = mode
+		return c
+	}
+
+	tests := []struct {
+		options    []Option
+		production bool
+		port       int
+		rootURL    string
+	}{
+		{[]Option{WithMode(config.ModeProduction), WithConfig(load(config.ModeDevelopment))}, true, 80, "https://golangnews.com"},
+		{[]Option{WithConfig(load(config.ModeDevelopment)), WithMode(config.ModeProduction)}, true, 80, "https://golangnews.com"},
+		{[]Option{WithMode(config.ModeDevelopment), WithConfig(load(config.ModeProduction))}, false, 3000, "https://localhost:3000"},
+		{[]Option{WithConfig(load(config.ModeProduction)), WithMode(config.ModeDevelopment)}, false, 3000, "https://localhost:3000"},
+		{[]Option{WithMode(config.ModeProduction)}, true, DefaultPort, ""},
+	}
+	for i, test := range tests {
+		s, err := NewWithOptions(test.options...)
+		if err != nil {
+			t.Fatalf("server: error creating server %s", err)
+		}
+		if s.Production() != test.production || s.Port() != test.port {
+			t.Fatalf("server: wrong mode for options %d got production:%v port:%d", i, s.Production(), s.Port())
+		}
+		if s.Config("root_url") != test.rootURL || s.Configuration()["root_url"] != test.rootURL {
+			t.Fatalf("server: wrong config for options %d got:%s", i, s.Config("root_url"))
+		}
+	}
+
+	// The config passed in is not changed
+	c := load(config.ModeDevelopment)
+	_, err := NewWithOptions(WithConfig(c), WithMode(config.ModeProduction))
+	if err != nil || c.Production() || c.Get("port") != "3000" {
+		t.Fatalf("server: config changed by mode got:%s err:%v", c.Get("port"), err)
+	}
+}
+
+// TestHTTPServer tests timeouts and limits are read from options, then config, then defaults.
+func TestHTTPServer(t *testing.T) {
+	s, err := NewWithOptions(WithTimeouts(Timeouts{Read: 5 * time.Minute, Idle: -1}))
+	if err != nil {
+		t.Fatalf("server: error creating server %s", err)
+	}
+	s.configDevelopment = map[string]string{
+		ConfigReadTimeout:    "1s",
+		ConfigWriteTimeout:   "10m",
+		ConfigMaxHeaderBytes: "4096",
+	}
+
+	server := s.httpServer(s.Addr(), nil, nil)
+	if server.ReadTimeout != 5*time.Minute {
+		t.Fatalf("server: option timeout not used got:%s", server.ReadTimeout)
+	}
+	if server.WriteTimeout != 10*time.Minute {
+		t.Fatalf("server: config timeout not used got:%s", server.WriteTimeout)
+	}
+	if server.ReadHeaderTimeout != DefaultTimeouts.ReadHeader {
+		t.Fatalf("server: default timeout not used got:%s", server.ReadHeaderTimeout)
+	}
+	if server.IdleTimeout >= 0 {
+		t.Fatalf("server: disabled timeout set got:%s", server.IdleTimeout)
+	}
+
+	// A disabled read header timeout must not fall back to the read timeout
+	s.configDevelopment[ConfigReadHeaderTimeout] = "none"
+	server = s.httpServer(s.Addr(), nil, nil)
+	if server.ReadHeaderTimeout >= 0 {
+		t.Fatalf("server: disabled timeout set got:%s", server.ReadHeaderTimeout)
+	}
+	if server.MaxHeaderBytes != 4096 {
+		t.Fatalf("server: config max header bytes not used got:%d", server.MaxHeaderBytes)
+	}
+}
+
+// TestCertManager tests autocert settings are read from options and config.
+func TestCertManager(t *testing.T) {
+	s, err := NewWithOptions()
+	if err != nil {
+		t.Fatalf("server: error creating server %s", err)
+	}
+	s.configDevelopment = map[string]string{
+		ConfigACMEDirectory: "https://localhost:14000/dir",
+		ConfigACMEEABKeyID:  "kid-1",
+		ConfigACMEEABKey:    "c2VjcmV0",
+	}
+
+	m, err := s.certManager("me@example.com", "example.com www.example.com")
+	if err != nil {
+		t.Fatalf("server: error creating cert manager %s", err)
+	}
+	if m.Client == nil || m.Client.DirectoryURL != "https://localhost:14000/dir" {
+		t.Fatalf("server: config directory not used")
+	}
+	if m.ExternalAccountBinding == nil || string(m.ExternalAccountBinding.Key) != "secret" {
+		t.Fatalf("server: config eab not used")
+	}
+	if m.HostPolicy(context.Background(), "www.example.com") != nil {
+		t.Fatalf("server: domain rejected by host policy")
+	}
+	if m.HostPolicy(context.Background(), "other.com") == nil {
+		t.Fatalf("server: domain accepted by host policy")
+	}
+
+	// Options take precedence over config
+	cache := autocert.DirCache(t.TempDir())
+	s, err = NewWithOptions(
+		WithACMEDirectory("https://acme.example.com/dir"),
+		WithCertCache(cache),
+		WithHostPolicy(func(ctx context.Context, host string) error { return nil }),
+	)
+	if err != nil {
+		t.Fatalf("server: error creating server %s", err)
+	}
+	m, err = s.certManager("me@example.com", "")
+	if err != nil {
+		t.Fatalf("server: error creating cert manager %s", err)
+	}
+	if m.Client.DirectoryURL != "https://acme.example.com/dir" || m.Cache != cache {
+		t.Fatalf("server: options not used")
+	}
+	if m.HostPolicy(context.Background(), "other.com") != nil {
+		t.Fatalf("server: host policy option not used")
+	}
+
+	// Protocols set in the tls config are not repeated
+	s, err = NewWithOptions(WithCertCache(cache), WithTLSConfig(&tls.Config{NextProtos: []string{"h2", "http/1.1"}}))
+	if err != nil {
+		t.Fatalf("server: error creating server %s", err)
+	}
+	server := s.ConfiguredTLSServer(m)
+	expected := []string{"h2", "http/1.1", acme.ALPNProto}
+	if !slices.Equal(server.TLSConfig.NextProtos, expected) {
+		t.Fatalf("server: wrong protocols expected:%v got:%v", expected, server.TLSConfig.NextProtos)
+	}
+
+	// Nothing is left serving if the tls config is invalid
+	s, err = NewWithOptions(
+		WithCertCache(cache),
+		WithListen("127.0.0.1:0"),
+		WithClientAuth(filepath.Join(t.TempDir(), "missing.pem"), tls.RequireAndVerifyClientCert),
+	)
+	if err != nil {
+		t.Fatalf("server: error creating server %s", err)
+	}
+	err = s.StartTLSAuto("me@example.com", "example.com")
+	if err == nil || len(s.servers) != 0 || len(s.listeners) != 0 {
+		t.Fatalf("server: servers left after error got:%d %d err:%v", len(s.servers), len(s.listeners), err)
+	}
+}
+
+// TestListenUnix tests serving on a unix socket from a listen spec.
+func TestListenUnix(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "app.sock")
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("unix"))
+	})
+
+	s, err := NewWithOptions(WithListen("unix:"+path), WithHandler(handler))
+	if err != nil {
+		t.Fatalf("server: error creating server %s", err)
+	}
+	s.SetShutdownSignals()
+
+	startErr := make(chan error, 1)
+	go func() {
+		startErr <- s.Start()
+	}()
+
+	client := &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				return (&net.Dialer{}).DialContext(ctx, "unix", path)
+			},
+		},
+	}
+
+	var resp *http.Response
+	for range 50 {
+		resp, err = client.Get("http://unix/")
+		if err == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatalf("server: error requesting over unix socket %s", err)
+	}
+	b, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(b) != "unix" {
+		t.Fatalf("server: wrong response got:%s", b)
+	}
+
+	err = s.Shutdown(context.Background())
+	if err != nil {
+		t.Fatalf("server: error shutting down %s", err)
+	}
+	if err := <-startErr; err != nil {
+		t.Fatalf("server: start returned error after shutdown %s", err)
+	}
+
+	// Listeners opened after shutdown are closed, and sockets removed
+	err = s.Start()
+	if err != nil {
+		t.Fatalf("server: start returned error after shutdown %s", err)
+	}
+	port := freePort(t)
+	s.StartRedirect(port, &Redirector{})
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatalf("server: unix socket not removed after shutdown")
+	}
+	l, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
+	if err != nil {
+		t.Fatalf("server: redirect listener not closed after shutdown %s", err)
+	}
+	l.Close()
+	if len(s.listeners) != 0 {
+		t.Fatalf("server: listeners registered after shutdown got:%v", s.listeners)
+	}
+}
+
+// TestAddresses tests bind addresses are read from options and config.
+func TestAddresses(t *testing.T) {
+	s, err := NewWithOptions(WithPort(4000))
+	if err != nil {
+		t.Fatalf("server: error creating server %s", err)
+	}
+	if got := s.Addresses(); len(got) != 1 || got[0] != ":4000" {
+		t.Fatalf("server: wrong default addresses got:%v", got)
+	}
+
+	s.configDevelopment = map[string]string{ConfigBind: "127.0.0.1, ::1 [::1]:5000"}
+	expected := []string{"127.0.0.1:4000", "[::1]:4000", "[::1]:5000"}
+	got := s.Addresses()
+	if len(got) != len(expected) {
+		t.Fatalf("server: wrong config addresses got:%v", got)
+	}
+	for i := range expected {
+		if got[i] != expected[i] {
+			t.Fatalf("server: wrong config addresses expected:%v got:%v", expected, got)
+		}
+	}
+	if got := s.addressesFor(80); len(got) != 2 || got[1] != "[::1]:80" {
+		t.Fatalf("server: wrong redirect addresses got:%v", got)
+	}
+
+	s, err = NewWithOptions(WithPort(4000), WithBind("localhost"))
+	if err != nil {
+		t.Fatalf("server: error creating server %s", err)
+	}
+	if s.Addr() != "localhost:4000" {
+		t.Fatalf("server: bind option not used got:%s", s.Addr())
+	}
+}
+
+// TestRedirector tests redirect urls and status codes.
+func TestRedirector(t *testing.T) {
+	tests := []struct {
+		redirector *Redirector
+		url        string
+		host       string
+		expected   string
+		status     int
+	}{
+		{NewRedirector("https://example.com"), "/users/1?q=a", "example.com", "https://example.com/users/1?q=a", 301},
+		{&Redirector{}, "/users", "Example.com:80", "https://example.com/users", 301},
+		{&Redirector{WWW: WWWAdd, Status: 308}, "/", "example.com", "https://www.example.com/", 308},
+		{&Redirector{WWW: WWWRemove, Status: 307}, "/a", "www.example.com", "https://example.com/a", 307},
+		{&Redirector{Host: "example.com", Path: "/"}, "/old?q=1", "other.com", "https://example.com/", 301},
+		{&Redirector{Port: 8443, Status: 999}, "/", "example.com", "https://example.com:8443/", 301},
+		{&Redirector{}, "/", "evil.com/<script>", "", 400},
+	}
+
+	for _, test := range tests {
+		r := httptest.NewRequest("GET", test.url, nil)
+		r.Host = test.host
+		w := httptest.NewRecorder()
+		test.redirector.ServeHTTP(w, r)
+
+		if w.Code != test.status {
+			t.Fatalf("server: wrong redirect status for %s expected:%d got:%d", test.url, test.status, w.Code)
+		}
+		if got := w.Header().Get("Location"); got != test.expected {
+			t.Fatalf("server: wrong redirect expected:%s got:%s", test.expected, got)
+		}
+	}
+}
+
+// TestSecurityHeaders tests headers are set from presets and config, with a nonce per request.
+func TestSecurityHeaders(t *testing.T) {
+	var nonce string
+	h := StrictSecurityHeaders().Middleware(func(w http.ResponseWriter, r *http.Request) {
+		nonce = CSPNonce(r)
+	})
+	w := httptest.NewRecorder()
+	h(w, httptest.NewRequest("GET", "/", nil))
+
+	if nonce == "" {
+		t.Fatalf("server: no csp nonce set")
+	}
+	csp := w.Header().Get("Content-Security-Policy")
+	if !strings.Contains(csp, "'nonce-"+nonce+"'") {
+		t.Fatalf("server: nonce not in csp got:%s", csp)
+	}
+	if w.Header().Get("X-Frame-Options") != "DENY" || w.Header().Get("Strict-Transport-Security") == "" {
+		t.Fatalf("server: strict headers not set got:%v", w.Header())
+	}
+
+	c := config.New()
+	err := c.Load("config/testdata/config.json")
+	if err != nil {
+		t.Fatalf("server: error loading config %s", err)
+	}
+	c.Set(ConfigSecurityReportOnly, "yes")
+	c.Set(ConfigSecurityFrameOptions, "none")
+
+	h = SecurityHeadersFromConfig(c).Middleware(func(w http.ResponseWriter, r *http.Request) {})
+	w = httptest.NewRecorder()
+	h(w, httptest.NewRequest("GET", "/", nil))
+	if w.Header().Get("Content-Security-Policy-Report-Only") == "" || w.Header().Get("Content-Security-Policy") != "" {
+		t.Fatalf("server: csp not report only got:%v", w.Header())
+	}
+	if w.Header().Get("X-Frame-Options") != "" {
+		t.Fatalf("server: header not removed by config got:%v", w.Header())
+	}
+}
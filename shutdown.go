@@ -0,0 +1,211 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/fragmenta/server/log"
+)
+
+// DefaultDrainTimeout is the time allowed for in-flight requests to complete
+// when the server is shut down by a signal.
+const DefaultDrainTimeout = 30 * time.Second
+
+// ShutdownHook is a function called during Shutdown after the http servers
+// have drained, for example to close a database or flush logs.
+type ShutdownHook func(ctx context.Context) error
+
+// SetDrainTimeout sets the time allowed for in-flight requests to complete
+// when shutting down in response to a signal.
+func (s *Server) SetDrainTimeout(d time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.drainTimeout = d
+}
+
+// DrainTimeout returns the time allowed for in-flight requests to complete
+// when shutting down in response to a signal.
+func (s *Server) DrainTimeout() time.Duration {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.drainTimeout <= 0 {
+		return DefaultDrainTimeout
+	}
+	return s.drainTimeout
+}
+
+// SetShutdownSignals sets the signals which trigger a graceful shutdown,
+// by default these are SIGINT and SIGTERM. Call with no arguments to disable
+// signal handling, for example if the app handles signals itself.
+func (s *Server) SetShutdownSignals(signals ...os.Signal) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.signals = signals
+}
+
+// OnShutdown registers a hook to be called on Shutdown once the http servers
+// have drained. Hooks are called in the order they were registered.
+func (s *Server) OnShutdown(hook ShutdownHook) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.hooks = append(s.hooks, hook)
+}
+
+// Shutdown gracefully stops all servers started by this Server, including
+// any redirect servers, waiting for in-flight requests to complete or for
+// ctx to expire, whichever is first. Shutdown hooks are then called in order.
+// Any blocking Start method returns nil once Shutdown has completed.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.mu.Lock()
+	done := s.doneChan()
+	if s.shutdown {
+		s.mu.Unlock()
+		// Wait for the shutdown already in progress
+		select {
+		case <-done:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	s.shutdown = true
+	servers := s.servers
+	hooks := s.hooks
+	s.mu.Unlock()
+
+	defer close(done)
+
+	// Drain all servers in parallel, as they share the same deadline
+	errs := make([]error, len(servers))
+	var wg sync.WaitGroup
+	for i, server := range servers {
+		wg.Go(func() {
+			err := server.Shutdown(ctx)
+			if err != nil {
+				// Drop any connections still open after the deadline
+				server.Close()
+			}
+			errs[i] = err
+		})
+	}
+	wg.Wait()
+
+	// Call hooks in order, even if draining failed
+	for _, hook := range hooks {
+		errs = append(errs, hook(ctx))
+	}
+
+	return errors.Join(errs...)
+}
+
+// doneChan returns the channel closed when shutdown completes,
+// it must be called with s.mu held.
+func (s *Server) doneChan() chan struct{} {
+	if s.done == nil {
+		s.done = make(chan struct{})
+	}
+	return s.done
+}
+
+// track registers an http server to be stopped on Shutdown,
+// it returns false if shutdown has already started.
+func (s *Server) track(server *http.Server) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.shutdown {
+		return false
+	}
+	s.servers = append(s.servers, server)
+	return true
+}
+
+// serve registers the http server for shutdown, starts listening for
+// signals and then calls start, which should block until the server stops.
+// If the server was stopped by Shutdown, serve waits for it to finish.
+// If shutdown has already started, the listeners for the server are closed.
+func (s *Server) serve(server *http.Server, listeners []net.Listener, start func() error) error {
+	if !s.track(server) {
+		s.closeListeners(listeners)
+		return nil
+	}
+	s.handleSignals()
+	s.handleUpgradeSignals()
+
+	// Our listeners are open, so tell the parent process (if any) on upgrade
+	notifyReady()
+
+	err := start()
+	if errors.Is(err, http.ErrServerClosed) {
+		s.mu.Lock()
+		done := s.doneChan()
+		s.mu.Unlock()
+		<-done
+		return nil
+	}
+	return err
+}
+
+// serveBackground starts a secondary server (for example a redirect server)
+// in a separate goroutine, it is stopped along with the main server.
+// If shutdown has already started, the listeners for the server are closed.
+func (s *Server) serveBackground(server *http.Server, listeners []net.Listener, start func() error) {
+	if !s.track(server) {
+		s.closeListeners(listeners)
+		return
+	}
+	go func() {
+		err := start()
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Error(log.V{log.MessageKey: "server: error serving", "addr": server.Addr, log.ErrorKey: err})
+		}
+	}()
+}
+
+// handleSignals starts a goroutine (once only) which calls Shutdown
+// when one of the shutdown signals is received.
+// A second signal closes all connections immediately.
+func (s *Server) handleSignals() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.handlingSignals || len(s.signals) == 0 {
+		return
+	}
+	s.handlingSignals = true
+
+	c := make(chan os.Signal, 2)
+	signal.Notify(c, s.signals...)
+	done := s.doneChan()
+
+	go func() {
+		defer signal.Stop(c)
+		select {
+		case sig := <-c:
+			log.Info(log.V{log.MessageKey: "server: shutting down", "signal": sig.String(), "drain": s.DrainTimeout()})
+			ctx, cancel := context.WithTimeout(context.Background(), s.DrainTimeout())
+			defer cancel()
+			go func() {
+				select {
+				case <-c:
+					log.Info(log.V{log.MessageKey: "server: second signal, closing connections"})
+					cancel()
+				case <-done:
+				}
+			}()
+			err := s.Shutdown(ctx)
+			if err != nil {
+				log.Error(log.V{log.MessageKey: "server: error shutting down", log.ErrorKey: err})
+			}
+		case <-done:
+		}
+	}()
+}
+
+// defaultSignals are the signals which trigger a graceful shutdown.
+var defaultSignals = []os.Signal{os.Interrupt, syscall.SIGTERM}
@@ -0,0 +1,28 @@
+package server
+
+import (
+	"os"
+	"time"
+)
+
+// DefaultUpgradeTimeout is the time allowed for a new process started by
+// Upgrade to report that it is ready before the upgrade is abandoned.
+const DefaultUpgradeTimeout = time.Minute
+
+// Environment variables used to pass listeners to a new process on upgrade.
+const (
+	// envUpgradeListeners lists the names of listeners passed, in fd order from fd 3
+	envUpgradeListeners = "FRAG_UPGRADE_LISTENERS"
+	// envUpgradeReady is the fd the new process writes to when ready
+	envUpgradeReady = "FRAG_UPGRADE_READY"
+)
+
+// SetUpgradeSignals sets the signals which trigger Upgrade, by default
+// there are none as Upgrade re-executes the binary. Pass
+// DefaultUpgradeSignals to upgrade on SIGUSR2, or call with no arguments
+// to disable upgrades by signal.
+func (s *Server) SetUpgradeSignals(signals ...os.Signal) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.upgradeSignals = signals
+}
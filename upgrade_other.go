@@ -0,0 +1,28 @@
+//go:build !unix
+
+package server
+
+import (
+	"errors"
+	"net"
+	"os"
+)
+
+// DefaultUpgradeSignals is empty as upgrades are not supported on this platform.
+var DefaultUpgradeSignals []os.Signal
+
+// Upgrade is not supported on this platform.
+func (s *Server) Upgrade() error {
+	return errors.New("server: upgrade is not supported on this platform")
+}
+
+// inheritedListener returns nil as listeners are not inherited on this platform.
+func inheritedListener(name string) (net.Listener, error) {
+	return nil, nil
+}
+
+// notifyReady does nothing as upgrades are not supported on this platform.
+func notifyReady() {}
+
+// handleUpgradeSignals does nothing as upgrades are not supported on this platform.
+func (s *Server) handleUpgradeSignals() {}
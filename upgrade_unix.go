@@ -0,0 +1,258 @@
+//go:build unix
+
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"os/signal"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/fragmenta/server/log"
+)
+
+// DefaultUpgradeSignals are the signals usually used to trigger an upgrade,
+// pass them to WithUpgradeSignals to enable upgrades by signal.
+var DefaultUpgradeSignals = []os.Signal{syscall.SIGUSR2}
+
+// Upgrade starts a new process from the current executable with the same
+// arguments, passing it the listeners for all servers started (http, https
+// and redirect). When the new process reports it is ready, this server is shut
+// down gracefully so that Start returns and the old process can exit.
+// If the new process fails to start, this server continues serving.
+//
+// Under systemd, set NotifyAccess=all or use a PIDFile, as the main pid changes.
+func (s *Server) Upgrade() error {
+	s.mu.Lock()
+	if s.upgrading || s.shutdown {
+		s.mu.Unlock()
+		return errors.New("server: upgrade or shutdown already in progress")
+	}
+	s.upgrading = true
+	listeners := make(map[string]net.Listener, len(s.listeners))
+	for name, l := range s.listeners {
+		listeners[name] = l
+	}
+	s.mu.Unlock()
+
+	defer func() {
+		s.mu.Lock()
+		s.upgrading = false
+		s.mu.Unlock()
+	}()
+
+	// Collect files for our listeners in a predictable order
+	names := make([]string, 0, len(listeners))
+	for name := range listeners {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+
+	var files []*os.File
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+	for _, name := range names {
+		filer, ok := listeners[name].(interface{ File() (*os.File, error) })
+		if !ok {
+			return fmt.Errorf("server: cannot pass listener %s to new process", name)
+		}
+		f, err := filer.File()
+		if err != nil {
+			return fmt.Errorf("server: error passing listener %s %v", name, err)
+		}
+		files = append(files, f)
+	}
+
+	// The new process reports it is ready by writing to this pipe
+	ready, readyWriter, err := os.Pipe()
+	if err != nil {
+		return fmt.Errorf("server: error creating ready pipe %v", err)
+	}
+	defer ready.Close()
+
+	path, err := os.Executable()
+	if err != nil {
+		readyWriter.Close()
+		return fmt.Errorf("server: error finding executable %v", err)
+	}
+
+	cmd := exec.Command(path, os.Args[1:]...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.ExtraFiles = append(files, readyWriter)
+	cmd.Env = upgradeEnv(names, listenFdsStart+len(files))
+
+	err = cmd.Start()
+	readyWriter.Close()
+	if err != nil {
+		return fmt.Errorf("server: error starting new process %v", err)
+	}
+
+	log.Info(log.V{log.MessageKey: "server: upgrading", "pid": cmd.Process.Pid, "listeners": names})
+
+	// Wait for the new process to report ready, exit or time out,
+	// if it exits the pipe is closed and the read fails
+	result := make(chan error, 1)
+	go func() {
+		b := make([]byte, 1)
+		_, err := ready.Read(b)
+		result <- err
+	}()
+
+	select {
+	case err = <-result:
+		if err != nil {
+			cmd.Wait()
+			return fmt.Errorf("server: new process failed to start %v", err)
+		}
+	case <-time.After(DefaultUpgradeTimeout):
+		cmd.Process.Kill()
+		cmd.Wait()
+		return errors.New("server: timed out waiting for new process")
+	}
+
+	// Release the new process, it is now responsible for our listeners
+	cmd.Process.Release()
+
+	// Don't remove unix sockets on close, the new process is using them
+	for _, l := range listeners {
+		if ul, ok := l.(*net.UnixListener); ok {
+			ul.SetUnlinkOnClose(false)
+		}
+	}
+
+	log.Info(log.V{log.MessageKey: "server: upgrade ready, shutting down", "pid": cmd.Process.Pid})
+
+	ctx, cancel := context.WithTimeout(context.Background(), s.DrainTimeout())
+	defer cancel()
+	return s.Shutdown(ctx)
+}
+
+// upgradeEnv returns the environment for the new process, listing the
+// listener names passed and the fd to report readiness on.
+func upgradeEnv(names []string, readyFd int) []string {
+	var env []string
+	for _, v := range os.Environ() {
+		// Remove our own variables and systemd socket activation variables,
+		// which do not apply to the new process
+		if strings.HasPrefix(v, envUpgradeListeners+"=") ||
+			strings.HasPrefix(v, envUpgradeReady+"=") ||
+			strings.HasPrefix(v, "LISTEN_") {
+			continue
+		}
+		env = append(env, v)
+	}
+	env = append(env, envUpgradeListeners+"="+strings.Join(names, ","))
+	env = append(env, envUpgradeReady+"="+strconv.Itoa(readyFd))
+	return env
+}
+
+// inherited stores the listeners passed by a parent process on upgrade.
+var inherited struct {
+	once      sync.Once
+	mu        sync.Mutex
+	listeners map[string]net.Listener
+	err       error
+}
+
+// inheritedListener returns the listener named passed by a parent process
+// on upgrade, or nil if there is none. Each listener is returned only once.
+func inheritedListener(name string) (net.Listener, error) {
+	inherited.once.Do(loadInheritedListeners)
+	if inherited.err != nil {
+		return nil, inherited.err
+	}
+	inherited.mu.Lock()
+	defer inherited.mu.Unlock()
+	l := inherited.listeners[name]
+	delete(inherited.listeners, name)
+	return l, nil
+}
+
+// loadInheritedListeners reads the listeners passed by a parent process.
+func loadInheritedListeners() {
+	names := os.Getenv(envUpgradeListeners)
+	if names == "" {
+		return
+	}
+	os.Unsetenv(envUpgradeListeners)
+
+	inherited.listeners = make(map[string]net.Listener)
+	for i, name := range strings.Split(names, ",") {
+		l, err := listenFd(uintptr(listenFdsStart+i), name)
+		if err != nil {
+			inherited.err = fmt.Errorf("server: error inheriting listener %s %v", name, err)
+			return
+		}
+		inherited.listeners[name] = l
+	}
+}
+
+// readyOnce ensures we only notify the parent process once.
+var readyOnce sync.Once
+
+// notifyReady tells the parent process (if any) that this process is
+// serving, so that the parent can shut down.
+func notifyReady() {
+	readyOnce.Do(func() {
+		fd, err := strconv.Atoi(os.Getenv(envUpgradeReady))
+		if err != nil {
+			return
+		}
+		os.Unsetenv(envUpgradeReady)
+
+		f := os.NewFile(uintptr(fd), "ready")
+		if f == nil {
+			return
+		}
+		defer f.Close()
+		_, err = f.Write([]byte{1})
+		if err != nil {
+			log.Error(log.V{log.MessageKey: "server: error notifying parent process", log.ErrorKey: err})
+		}
+	})
+}
+
+// handleUpgradeSignals starts a goroutine (once only) which calls Upgrade
+// when one of the upgrade signals is received.
+func (s *Server) handleUpgradeSignals() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.handlingUpgrades || len(s.upgradeSignals) == 0 {
+		return
+	}
+	s.handlingUpgrades = true
+
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, s.upgradeSignals...)
+	done := s.doneChan()
+
+	go func() {
+		defer signal.Stop(c)
+		for {
+			select {
+			case sig := <-c:
+				log.Info(log.V{log.MessageKey: "server: upgrade requested", "signal": sig.String()})
+				err := s.Upgrade()
+				if err != nil {
+					log.Error(log.V{log.MessageKey: "server: error upgrading", log.ErrorKey: err})
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+}
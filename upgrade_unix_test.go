@@ -0,0 +1,177 @@
+//go:build unix
+
+package server
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestUpgradeEnv tests the new process is passed our listeners, without
+// the upgrade or systemd variables meant for this process.
+func TestUpgradeEnv(t *testing.T) {
+	t.Setenv("LISTEN_PID", "1")
+	t.Setenv("LISTEN_FDS", "2")
+	t.Setenv("LISTEN_FDNAMES", "web:admin")
+	t.Setenv(envUpgradeListeners, "old")
+	t.Setenv(envUpgradeReady, "9")
+	t.Setenv("FRAG_ENV", "production")
+
+	var upgrade []string
+	kept := false
+	for _, v := range upgradeEnv([]string{"main", "redirect:80"}, 5) {
+		switch {
+		case strings.HasPrefix(v, "LISTEN_"):
+			t.Fatalf("server: systemd variable passed to new process got:%s", v)
+		case strings.HasPrefix(v, "FRAG_UPGRADE_"):
+			upgrade = append(upgrade, v)
+		case v == "FRAG_ENV=production":
+			kept = true
+		}
+	}
+	expected := []string{envUpgradeListeners + "=main,redirect:80", envUpgradeReady + "=5"}
+	if !slices.Equal(upgrade, expected) || !kept {
+		t.Fatalf("server: wrong upgrade env expected:%v got:%v", expected, upgrade)
+	}
+}
+
+// TestInheritedListeners tests listeners passed by a parent process are
+// found by name from fd 3 in order, and are returned only once.
+func TestInheritedListeners(t *testing.T) {
+	if os.Getenv(envUpgradeListeners) != "" {
+		// Running as the new process started below
+		addrs := strings.Split(os.Getenv("FRAG_TEST_ADDRS"), ",")
+		for i, name := range []string{"web", "admin"} {
+			l, err := inheritedListener(name)
+			if err != nil || l == nil || l.Addr().String() != addrs[i] {
+				t.Fatalf("server: wrong listener for %s expected:%s got:%v err:%v", name, addrs[i], l, err)
+			}
+			l, err = inheritedListener(name)
+			if err != nil || l != nil {
+				t.Fatalf("server: listener %s returned twice", name)
+			}
+		}
+		return
+	}
+
+	var files []*os.File
+	var addrs []string
+	for range 2 {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("server: error listening %s", err)
+		}
+		defer l.Close()
+		f, err := l.(*net.TCPListener).File()
+		if err != nil {
+			t.Fatalf("server: error getting listener file %s", err)
+		}
+		defer f.Close()
+		files = append(files, f)
+		addrs = append(addrs, l.Addr().String())
+	}
+
+	cmd := exec.Command(os.Args[0], "-test.run=^TestInheritedListeners$", "-test.v")
+	cmd.ExtraFiles = files
+	cmd.Env = append(os.Environ(), envUpgradeListeners+"=web,admin", "FRAG_TEST_ADDRS="+strings.Join(addrs, ","))
+	out, err := cmd.CombinedOutput()
+	if err != nil || !strings.Contains(string(out), "--- PASS: TestInheritedListeners") {
+		t.Fatalf("server: listeners not inherited got:%s", out)
+	}
+}
+
+// TestUpgrade tests a new process takes over our listener on Upgrade,
+// and that Start returns nil once the new process is ready.
+func TestUpgrade(t *testing.T) {
+	var s *Server
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "%d", os.Getpid())
+	})
+	mux.HandleFunc("/exit", func(w http.ResponseWriter, r *http.Request) {
+		go s.Shutdown(context.Background())
+	})
+
+	s, err := NewWithOptions(WithHandler(mux), WithListen("127.0.0.1:0"))
+	if err != nil {
+		t.Fatalf("server: error creating server %s", err)
+	}
+	s.SetShutdownSignals()
+
+	// Running as the new process, serve on the inherited listener until /exit
+	if os.Getenv(envUpgradeListeners) != "" {
+		err = s.Start()
+		if err != nil {
+			t.Fatalf("server: error serving in new process %s", err)
+		}
+		return
+	}
+
+	started := make(chan error, 1)
+	go func() {
+		started <- s.Start()
+	}()
+	var addr string
+	for i := 0; i < 100 && addr == ""; i++ {
+		time.Sleep(10 * time.Millisecond)
+		s.mu.Lock()
+		if l := s.listeners[listenerMain]; l != nil {
+			addr = l.Addr().String()
+		}
+		s.mu.Unlock()
+	}
+	if addr == "" {
+		t.Fatalf("server: server not listening")
+	}
+
+	// Run only this test in the new process, discarding its output
+	devNull, err := os.OpenFile(os.DevNull, os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatalf("server: error opening %s %s", os.DevNull, err)
+	}
+	defer devNull.Close()
+	args, stdout := os.Args, os.Stdout
+	os.Args = []string{os.Args[0], "-test.run=^TestUpgrade$", "-test.timeout=30s"}
+	os.Stdout = devNull
+	err = s.Upgrade()
+	os.Args, os.Stdout = args, stdout
+	if err != nil {
+		t.Fatalf("server: error upgrading %s", err)
+	}
+
+	select {
+	case err = <-started:
+		if err != nil {
+			t.Fatalf("server: error from Start after upgrade %s", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("server: Start did not return after upgrade")
+	}
+
+	// Requests are now served by the new process
+	resp, err := http.Get("http://" + addr + "/")
+	if err != nil {
+		t.Fatalf("server: error requesting new process %s", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	pid, err := strconv.Atoi(string(body))
+	if err != nil || pid == os.Getpid() {
+		t.Fatalf("server: request not served by new process got:%s", body)
+	}
+
+	resp, err = http.Get("http://" + addr + "/exit")
+	if err == nil {
+		resp.Body.Close()
+	}
+}